@@ -0,0 +1,396 @@
+// Package bencode encodes and decodes bencoding, the serialization format of BitTorrent (BEP 3).
+package bencode
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+)
+
+// DecodeError is an error in bencoded input, at a byte offset of the input.
+type DecodeError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.Msg, e.Offset)
+}
+
+// bencodeParser is a validating bencode parser; It only accepts the canonical encoding of every value,
+// and never reads past the end of the input. Every node records the bytes it was decoded from in Raw.
+type bencodeParser struct {
+	s     string
+	pos   int
+	depth int
+	// allowUnsortedKeys accepts dictionaries with keys out of order, which some torrent files have
+	allowUnsortedKeys bool
+}
+
+func (p *bencodeParser) errorf(offset int, format string, args ...any) error {
+	return &DecodeError{Offset: offset, Msg: fmt.Sprintf(format, args...)}
+}
+
+// parseValue parses the value of any type at the current position.
+func (p *bencodeParser) parseValue() (BNode, error) {
+	if p.pos >= len(p.s) {
+		return BNode{}, p.errorf(p.pos, "unexpected end of input")
+	}
+
+	var r BNode
+	var err error
+	start := p.pos
+	switch ch := p.s[p.pos]; {
+	case ch == 'i':
+		r, err = p.parseInt()
+	case ch == 'l':
+		r, err = p.parseList()
+	case ch == 'd':
+		r, err = p.parseDict()
+	case ch >= '0' && ch <= '9':
+		r, err = p.parseString()
+	default:
+		return BNode{}, p.errorf(p.pos, "unknown bencoded value %q", ch)
+	}
+	if err != nil {
+		return BNode{}, err
+	}
+
+	r.Raw = p.s[start:p.pos]
+	return r, nil
+}
+
+// parseDigits reads an unsigned decimal number without leading zeros, up to the delimiter.
+func (p *bencodeParser) parseDigits(delimiter byte) (string, error) {
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != delimiter {
+		if p.s[p.pos] < '0' || p.s[p.pos] > '9' {
+			return "", p.errorf(p.pos, "unexpected character %q in number", p.s[p.pos])
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.s) {
+		return "", p.errorf(start, "unterminated number")
+	}
+
+	digits := p.s[start:p.pos]
+	if digits == "" {
+		return "", p.errorf(start, "empty number")
+	}
+	if len(digits) > 1 && digits[0] == '0' {
+		return "", p.errorf(start, "number with leading zero")
+	}
+
+	// Skip the delimiter
+	p.pos++
+	return digits, nil
+}
+
+// parseString parses a string like `5:hello`.
+func (p *bencodeParser) parseString() (BNode, error) {
+	start := p.pos
+	digits, err := p.parseDigits(':')
+	if err != nil {
+		return BNode{}, err
+	}
+
+	length, err := strconv.Atoi(digits)
+	if err != nil || length > len(p.s)-p.pos {
+		return BNode{}, p.errorf(start, "string length %s exceeds the input", digits)
+	}
+
+	r := BNode{Type: BString, Str: p.s[p.pos : p.pos+length]}
+	p.pos += length
+	return r, nil
+}
+
+// parseInt parses an integer like `i-42e`.
+func (p *bencodeParser) parseInt() (BNode, error) {
+	start := p.pos
+	// Skip the `i`
+	p.pos++
+
+	negative := p.pos < len(p.s) && p.s[p.pos] == '-'
+	if negative {
+		p.pos++
+	}
+	digits, err := p.parseDigits('e')
+	if err != nil {
+		return BNode{}, err
+	}
+	if negative && digits == "0" {
+		return BNode{}, p.errorf(start, "negative zero")
+	}
+
+	return newIntNode(p.s[start+1 : p.pos-1]), nil
+}
+
+// newIntNode returns the node of a valid decimal integer, with BigInt set if it doesn't fit an int.
+func newIntNode(number string) BNode {
+	i, err := strconv.Atoi(number)
+	if err == nil {
+		return BNode{Type: BInt, Int: i}
+	}
+
+	bigInt, ok := new(big.Int).SetString(number, 10)
+	if !ok {
+		return BNode{Type: BInt}
+	}
+	return BNode{Type: BInt, BigInt: bigInt}
+}
+
+// enter checks the nesting depth before parsing the items of a list or dictionary.
+func (p *bencodeParser) enter() error {
+	p.depth++
+	if p.depth > maxDecodeDepth {
+		return p.errorf(p.pos, "nesting too deep")
+	}
+	// Skip the `l` or `d`
+	p.pos++
+	return nil
+}
+
+// parseList parses a list like `l5:helloi42ee`.
+func (p *bencodeParser) parseList() (BNode, error) {
+	r := BNode{Type: BList, List: make([]*BNode, 0)}
+	err := p.enter()
+	if err != nil {
+		return BNode{}, err
+	}
+
+	for p.pos < len(p.s) && p.s[p.pos] != 'e' {
+		item, err := p.parseValue()
+		if err != nil {
+			return BNode{}, err
+		}
+		r.List = append(r.List, &item)
+	}
+	if p.pos >= len(p.s) {
+		return BNode{}, p.errorf(p.pos, "unterminated list")
+	}
+
+	p.pos++
+	p.depth--
+	return r, nil
+}
+
+// parseDict parses a dictionary like `d3:foo3:bare`; Keys must be strings in strictly increasing order.
+func (p *bencodeParser) parseDict() (BNode, error) {
+	r := BNode{Type: BDict, Dict: make(map[string]*BNode)}
+	err := p.enter()
+	if err != nil {
+		return BNode{}, err
+	}
+
+	previousKey := ""
+	for p.pos < len(p.s) && p.s[p.pos] != 'e' {
+		keyStart := p.pos
+		if p.s[p.pos] < '0' || p.s[p.pos] > '9' {
+			return BNode{}, p.errorf(keyStart, "dictionary key is not a string")
+		}
+		key, err := p.parseString()
+		if err != nil {
+			return BNode{}, err
+		}
+		if _, ok := r.Dict[key.Str]; ok {
+			return BNode{}, p.errorf(keyStart, "duplicate dictionary key %q", key.Str)
+		}
+		if len(r.Dict) > 0 && key.Str < previousKey && !p.allowUnsortedKeys {
+			return BNode{}, p.errorf(keyStart, "dictionary key %q is not sorted", key.Str)
+		}
+		previousKey = key.Str
+
+		item, err := p.parseValue()
+		if err != nil {
+			return BNode{}, err
+		}
+		r.Dict[key.Str] = &item
+	}
+	if p.pos >= len(p.s) {
+		return BNode{}, p.errorf(p.pos, "unterminated dictionary")
+	}
+
+	p.pos++
+	p.depth--
+	return r, nil
+}
+
+// DecodeBencodeString decodes a bencoded string and returns a BNode, parsed length, and an error if any.
+func DecodeBencodeString(s string) (BNode, int, error) {
+	if len(s) == 0 || s[0] < '0' || s[0] > '9' {
+		return BNode{}, 0, &DecodeError{Offset: 0, Msg: "string must start with its length"}
+	}
+	p := &bencodeParser{s: s}
+	r, err := p.parseValue()
+	return r, p.pos, err
+}
+
+// DecodeBencodeInt decodes a bencoded integer and returns a BNode, parsed length, and an error if any.
+func DecodeBencodeInt(s string) (BNode, int, error) {
+	if len(s) == 0 || s[0] != 'i' {
+		return BNode{}, 0, &DecodeError{Offset: 0, Msg: "integer must start with 'i'"}
+	}
+	p := &bencodeParser{s: s}
+	r, err := p.parseValue()
+	return r, p.pos, err
+}
+
+// DecodeBencodeList decodes a bencoded list and returns a BNode, parsed length, and an error if any.
+func DecodeBencodeList(s string) (BNode, int, error) {
+	if len(s) == 0 || s[0] != 'l' {
+		return BNode{}, 0, &DecodeError{Offset: 0, Msg: "list must start with 'l'"}
+	}
+	p := &bencodeParser{s: s}
+	r, err := p.parseValue()
+	return r, p.pos, err
+}
+
+// DecodeBencodeDict decodes a bencoded dictionary and returns a BNode, parsed length, and an error if any.
+func DecodeBencodeDict(s string) (BNode, int, error) {
+	if len(s) == 0 || s[0] != 'd' {
+		return BNode{}, 0, &DecodeError{Offset: 0, Msg: "dictionary must start with 'd'"}
+	}
+	p := &bencodeParser{s: s}
+	r, err := p.parseValue()
+	return r, p.pos, err
+}
+
+// DecodeBencode decodes a complete bencoded string and returns a BNode and an error if any.
+// Data after the value is an error.
+func DecodeBencode(bencodedString string) (BNode, error) {
+	return decodeBencode(bencodedString, false)
+}
+
+// decodeBencode decodes a complete bencoded string, optionally accepting unsorted dictionary keys.
+func decodeBencode(s string, allowUnsortedKeys bool) (BNode, error) {
+	p := &bencodeParser{s: s, allowUnsortedKeys: allowUnsortedKeys}
+	node, err := p.parseValue()
+	if err != nil {
+		return BNode{}, err
+	}
+	if p.pos != len(s) {
+		return BNode{}, &DecodeError{Offset: p.pos, Msg: "trailing data after value"}
+	}
+	return node, nil
+}
+
+// decodeBencodeValue decodes the bencoded value of any type at the start of s and returns a BNode, parsed length, and an error if any.
+// Unlike DecodeBencode, data after the value is allowed.
+func decodeBencodeValue(s string) (BNode, int, error) {
+	p := &bencodeParser{s: s}
+	r, err := p.parseValue()
+	return r, p.pos, err
+}
+
+// MarshalBNode encodes a BNode into JSON format.
+// Strings which are not valid UTF-8 are not kept as is; Use MarshalBNodeLossless to encode them back.
+func MarshalBNode(node *BNode) ([]byte, error) {
+	var b []byte
+	var err error
+
+	switch node.Type {
+	case BString:
+		b, err = json.Marshal(node.Str)
+
+	case BInt:
+		if node.BigInt != nil {
+			b, err = json.Marshal(node.BigInt)
+		} else {
+			b, err = json.Marshal(node.Int)
+		}
+
+	case BList:
+		// Convert list elements to JSON
+		encodedList := make([]json.RawMessage, 0)
+		for _, item := range node.List {
+			encodedItem, err := MarshalBNode(item)
+			if err != nil {
+				return nil, err
+			}
+			encodedList = append(encodedList, encodedItem)
+		}
+		b, err = json.Marshal(encodedList)
+
+	case BDict:
+		// Convert dictionary values to JSON
+		encodedDict := make(map[string]json.RawMessage)
+		for key, value := range node.Dict {
+			encodedItem, err := MarshalBNode(value)
+			if err != nil {
+				return nil, err
+			}
+			encodedDict[key] = encodedItem
+		}
+		b, err = json.Marshal(encodedDict)
+	}
+
+	return b, err
+}
+
+// EncodeBNode encodes a BNode into a bencode-encoded byte slice based on its type.
+func EncodeBNode(node BNode) []byte {
+	switch node.Type {
+	case BString:
+		return EncodeBencodeString(node.Str)
+	case BInt:
+		if node.BigInt != nil {
+			return []byte("i" + node.BigInt.String() + "e")
+		}
+		return EncodeBencodeInt(node.Int)
+	case BList:
+		return EncodeBencodeList(node)
+	case BDict:
+		return EncodeBencodeDict(node)
+	default:
+		log.Fatalf("Unknown node type: %d", node.Type)
+	}
+	return nil
+}
+
+// EncodeBencodeString encodes a string into bencode format.
+func EncodeBencodeString(s string) []byte {
+	// TODO: Check if we have to store as []byte instead of string in the BNode
+	return []byte(fmt.Sprintf("%d:%s", len(s), s))
+}
+
+// EncodeBencodeInt encodes an integer into bencode format.
+func EncodeBencodeInt(i int) []byte {
+	return []byte(fmt.Sprintf("i%de", i))
+}
+
+// EncodeBencodeList encodes a list of BNodes into bencode format.
+func EncodeBencodeList(node BNode) []byte {
+	encodedList := []byte("l")
+	for _, item := range node.List {
+		encodedItem := EncodeBNode(*item)
+		encodedList = append(encodedList, encodedItem...)
+	}
+	encodedList = append(encodedList, 'e')
+	return encodedList
+}
+
+// EncodeBencodeDict encodes a dictionary of BNodes into bencode format.
+func EncodeBencodeDict(node BNode) []byte {
+	encodedDict := []byte("d")
+
+	// Extract and sort keys lexicographically
+	keys := make([]string, 0, len(node.Dict))
+	for key := range node.Dict {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Encode each key-value pair in sorted order
+	for _, key := range keys {
+		encodedKey := EncodeBencodeString(key)
+		encodedValue := EncodeBNode(*node.Dict[key])
+		encodedDict = append(encodedDict, encodedKey...)
+		encodedDict = append(encodedDict, encodedValue...)
+	}
+
+	encodedDict = append(encodedDict, 'e')
+	return encodedDict
+}
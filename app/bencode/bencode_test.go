@@ -0,0 +1,128 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// validBencode are well-formed values, used to check decoding and as seeds of the fuzz target.
+var validBencode = []string{
+	"0:",
+	"5:hello",
+	"i0e",
+	"i-42e",
+	"i123456789012345678901234567890e",
+	"le",
+	"l5:helloi42ee",
+	"de",
+	"d3:bar4:spam3:fooi42ee",
+	"d4:infod6:lengthi3e4:name1:aee",
+	"lli1eeld1:ai2eeee",
+}
+
+func TestDecodeBencodeRoundTrip(t *testing.T) {
+	for _, input := range validBencode {
+		node, err := DecodeBencode(input)
+		if err != nil {
+			t.Errorf("DecodeBencode(%q): %v", input, err)
+			continue
+		}
+		if node.Raw != input {
+			t.Errorf("DecodeBencode(%q).Raw = %q", input, node.Raw)
+		}
+		if encoded := EncodeBNode(node); string(encoded) != input {
+			t.Errorf("EncodeBNode(DecodeBencode(%q)) = %q", input, encoded)
+		}
+	}
+}
+
+func TestDecodeBencodeRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// err is a part of the expected error message
+		err string
+	}{
+		{"empty input", "", "unexpected end of input"},
+		{"unknown type", "x", "unknown bencoded value"},
+		{"integer with leading zero", "i03e", "leading zero"},
+		{"negative integer with leading zero", "i-03e", "leading zero"},
+		{"negative zero", "i-0e", "negative zero"},
+		{"empty integer", "ie", "empty number"},
+		{"minus without digits", "i-e", "empty number"},
+		{"unterminated integer", "i42", "unterminated number"},
+		{"integer with letters", "i4x2e", "unexpected character"},
+		{"string length with leading zero", "05:hello", "leading zero"},
+		{"truncated string", "5:hell", "exceeds the input"},
+		{"truncated string in list", "l5:hell", "exceeds the input"},
+		{"string without colon", "5hello", "unexpected character"},
+		{"unterminated list", "li1e", "unterminated list"},
+		{"unterminated dictionary", "d1:ai1e", "unterminated dictionary"},
+		{"dictionary without value", "d1:ae", "unknown bencoded value"},
+		{"unsorted keys", "d1:bi1e1:ai2ee", "not sorted"},
+		{"duplicate keys", "d1:ai1e1:ai2ee", "duplicate dictionary key"},
+		{"integer key", "di1ei2ee", "key is not a string"},
+		{"trailing data", "i42ei43e", "trailing data"},
+		{"trailing newline", "4:spam\n", "trailing data"},
+		{"nesting too deep", strings.Repeat("l", maxDecodeDepth+1) + strings.Repeat("e", maxDecodeDepth+1), "nesting too deep"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeBencode(tt.input)
+			if err == nil {
+				t.Fatalf("DecodeBencode(%q) succeeded, want error %q", tt.input, tt.err)
+			}
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("DecodeBencode(%q) error %T is not a DecodeError", tt.input, err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("DecodeBencode(%q) error = %q, want %q", tt.input, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDecodeBencodeUnsortedKeys(t *testing.T) {
+	input := "d1:bi1e1:ai2ee"
+	node, err := decodeBencode(input, true)
+	if err != nil {
+		t.Fatalf("decodeBencode(%q) with unsorted keys: %v", input, err)
+	}
+	if node.Raw != input {
+		t.Errorf("Raw = %q, want the original order %q", node.Raw, input)
+	}
+
+	// Duplicate keys are still an error
+	_, err = decodeBencode("d1:bi1e1:ai2e1:bi3ee", true)
+	if err == nil || !strings.Contains(err.Error(), "duplicate dictionary key") {
+		t.Errorf("decodeBencode with duplicate unsorted keys: error = %v", err)
+	}
+}
+
+// FuzzDecodeBencode checks that every value the decoder accepts is encoded back to the same bytes;
+// A strict decoder accepts exactly one encoding of each value.
+func FuzzDecodeBencode(f *testing.F) {
+	for _, input := range validBencode {
+		f.Add([]byte(input))
+	}
+	f.Add([]byte("i-0e"))
+	f.Add([]byte("d1:bi1e1:ai2ee"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		node, err := DecodeBencode(string(data))
+		if err != nil {
+			return
+		}
+		if node.Raw != string(data) {
+			t.Fatalf("Raw = %q, want %q", node.Raw, data)
+		}
+		encoded := EncodeBNode(node)
+		if !bytes.Equal(encoded, data) {
+			t.Fatalf("EncodeBNode(DecodeBencode(%q)) = %q", data, encoded)
+		}
+	})
+}
@@ -0,0 +1,228 @@
+package bencode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// BinaryEncoding selects how MarshalBNodeLossless writes strings which are not valid UTF-8.
+type BinaryEncoding string
+
+const (
+	BinaryHex    BinaryEncoding = "hex"
+	BinaryBase64 BinaryEncoding = "base64"
+)
+
+// Type markers of the lossless JSON format. A binary string is written as `{"$hex": "..."}` or
+// `{"$base64": "..."}`. A dictionary which has binary keys, or which would be mistaken for a marker,
+// is written as `{"$dict": [[key, value], ...]}`.
+const (
+	jsonHexMarker    = "$hex"
+	jsonBase64Marker = "$base64"
+	jsonDictMarker   = "$dict"
+)
+
+// MarshalBNodeLossless encodes a BNode into JSON which UnmarshalBNodeLossless turns back into the same BNode.
+// Unlike MarshalBNode, strings which are not valid UTF-8, like piece hashes, are kept byte for byte.
+func MarshalBNodeLossless(node *BNode, encoding BinaryEncoding) ([]byte, error) {
+	if encoding != BinaryHex && encoding != BinaryBase64 {
+		return nil, fmt.Errorf("unknown binary encoding: %q", encoding)
+	}
+	return json.Marshal(losslessValue(node, encoding))
+}
+
+// losslessValue converts a BNode to values which encoding/json marshals in the lossless format.
+func losslessValue(node *BNode, encoding BinaryEncoding) any {
+	switch node.Type {
+	case BString:
+		return losslessString(node.Str, encoding)
+
+	case BInt:
+		if node.BigInt != nil {
+			return node.BigInt
+		}
+		return node.Int
+
+	case BList:
+		list := make([]any, 0, len(node.List))
+		for _, item := range node.List {
+			list = append(list, losslessValue(item, encoding))
+		}
+		return list
+
+	default:
+		if !needsDictMarker(node.Dict) {
+			dict := make(map[string]any, len(node.Dict))
+			for key, value := range node.Dict {
+				dict[key] = losslessValue(value, encoding)
+			}
+			return dict
+		}
+
+		keys := make([]string, 0, len(node.Dict))
+		for key := range node.Dict {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		pairs := make([][2]any, 0, len(keys))
+		for _, key := range keys {
+			pairs = append(pairs, [2]any{losslessString(key, encoding), losslessValue(node.Dict[key], encoding)})
+		}
+		return map[string]any{jsonDictMarker: pairs}
+	}
+}
+
+// losslessString returns the string as is if it is valid UTF-8, or wrapped in a binary marker.
+func losslessString(s string, encoding BinaryEncoding) any {
+	if utf8.ValidString(s) {
+		return s
+	}
+	if encoding == BinaryBase64 {
+		return map[string]string{jsonBase64Marker: base64.StdEncoding.EncodeToString([]byte(s))}
+	}
+	return map[string]string{jsonHexMarker: hex.EncodeToString([]byte(s))}
+}
+
+// needsDictMarker reports whether a dictionary can't be written as a plain JSON object.
+func needsDictMarker(dict map[string]*BNode) bool {
+	for key := range dict {
+		if !utf8.ValidString(key) {
+			return true
+		}
+		if len(dict) == 1 && (key == jsonHexMarker || key == jsonBase64Marker || key == jsonDictMarker) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalBNodeLossless parses JSON written by MarshalBNodeLossless back into a BNode.
+// Plain JSON of strings, integers, arrays and objects is accepted as well.
+func UnmarshalBNodeLossless(data []byte) (BNode, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value any
+	err := decoder.Decode(&value)
+	if err != nil {
+		return BNode{}, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if decoder.More() {
+		return BNode{}, fmt.Errorf("invalid JSON: data after value")
+	}
+
+	return bnodeFromJSON(value)
+}
+
+// bnodeFromJSON converts a value decoded by encoding/json to a BNode.
+func bnodeFromJSON(value any) (BNode, error) {
+	switch v := value.(type) {
+	case string:
+		return BNode{Type: BString, Str: v}, nil
+
+	case json.Number:
+		// Only integers in the canonical form, like bencode ones, are accepted
+		node, err := DecodeBencode("i" + v.String() + "e")
+		if err != nil || node.Type != BInt {
+			return BNode{}, fmt.Errorf("invalid integer: %s", v)
+		}
+		node.Raw = ""
+		return node, nil
+
+	case []any:
+		r := BNode{Type: BList, List: make([]*BNode, 0, len(v))}
+		for _, item := range v {
+			node, err := bnodeFromJSON(item)
+			if err != nil {
+				return BNode{}, err
+			}
+			r.List = append(r.List, &node)
+		}
+		return r, nil
+
+	case map[string]any:
+		if len(v) == 1 {
+			for key, inner := range v {
+				switch key {
+				case jsonHexMarker, jsonBase64Marker:
+					return binaryFromJSON(key, inner)
+				case jsonDictMarker:
+					return dictFromJSONPairs(inner)
+				}
+			}
+		}
+
+		r := BNode{Type: BDict, Dict: make(map[string]*BNode, len(v))}
+		for key, item := range v {
+			node, err := bnodeFromJSON(item)
+			if err != nil {
+				return BNode{}, err
+			}
+			r.Dict[key] = &node
+		}
+		return r, nil
+
+	default:
+		return BNode{}, fmt.Errorf("unsupported JSON value: %v", value)
+	}
+}
+
+// binaryFromJSON decodes the content of a `$hex` or `$base64` marker.
+func binaryFromJSON(marker string, value any) (BNode, error) {
+	encoded, ok := value.(string)
+	if !ok {
+		return BNode{}, fmt.Errorf("%s must be a string", marker)
+	}
+
+	var decoded []byte
+	var err error
+	if marker == jsonHexMarker {
+		decoded, err = hex.DecodeString(encoded)
+	} else {
+		decoded, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil {
+		return BNode{}, fmt.Errorf("invalid %s string: %v", marker, err)
+	}
+	return BNode{Type: BString, Str: string(decoded)}, nil
+}
+
+// dictFromJSONPairs decodes the `[[key, value], ...]` content of a `$dict` marker.
+func dictFromJSONPairs(value any) (BNode, error) {
+	pairs, ok := value.([]any)
+	if !ok {
+		return BNode{}, fmt.Errorf("%s must be a list of pairs", jsonDictMarker)
+	}
+
+	r := BNode{Type: BDict, Dict: make(map[string]*BNode, len(pairs))}
+	for _, pair := range pairs {
+		items, ok := pair.([]any)
+		if !ok || len(items) != 2 {
+			return BNode{}, fmt.Errorf("%s must be a list of pairs", jsonDictMarker)
+		}
+
+		key, err := bnodeFromJSON(items[0])
+		if err != nil {
+			return BNode{}, err
+		}
+		if key.Type != BString {
+			return BNode{}, fmt.Errorf("dictionary key must be a string")
+		}
+		if _, ok := r.Dict[key.Str]; ok {
+			return BNode{}, fmt.Errorf("duplicate dictionary key %q", key.Str)
+		}
+
+		item, err := bnodeFromJSON(items[1])
+		if err != nil {
+			return BNode{}, err
+		}
+		r.Dict[key.Str] = &item
+	}
+	return r, nil
+}
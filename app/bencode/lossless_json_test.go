@@ -0,0 +1,130 @@
+package bencode
+
+import (
+	"crypto/sha1"
+	"strings"
+	"testing"
+)
+
+// testTorrent returns a torrent file with a real binary `pieces` field.
+func testTorrent(t *testing.T) string {
+	t.Helper()
+	first := sha1.Sum([]byte("first piece"))
+	second := sha1.Sum([]byte("second piece"))
+	data, err := Marshal(map[string]any{
+		"announce": "http://tracker/announce",
+		"info": map[string]any{
+			"length":       20000,
+			"name":         "sample.txt",
+			"piece length": 16384,
+			"pieces":       string(first[:]) + string(second[:]),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	return string(data)
+}
+
+func TestLosslessJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// marker is the marker the JSON must use, if any; "binary" is the marker of the encoding
+		marker string
+	}{
+		{"plain values", "d4:listli1ei-2e3:abce3:numi42e3:str5:helloe", ""},
+		{"big integer", "li123456789012345678901234567890ee", ""},
+		{"torrent with binary pieces", testTorrent(t), "binary"},
+		{"binary string", "3:\xff\x00\x01", "binary"},
+		{"binary dictionary key", "d2:\xff\xfei1ee", jsonDictMarker},
+		{"key named like the hex marker", "d4:$hex4:cafee", jsonDictMarker},
+		{"key named like the base64 marker", "d7:$base644:cafee", jsonDictMarker},
+		{"key named like the dict marker", "d5:$dictlee", jsonDictMarker},
+		{"marker key next to another key", "d4:$hex4:cafe1:xi1ee", ""},
+		{"empty dictionary", "de", ""},
+	}
+
+	for _, encoding := range []BinaryEncoding{BinaryHex, BinaryBase64} {
+		binaryMarker := jsonHexMarker
+		if encoding == BinaryBase64 {
+			binaryMarker = jsonBase64Marker
+		}
+
+		for _, tt := range tests {
+			t.Run(string(encoding)+"/"+tt.name, func(t *testing.T) {
+				node, err := DecodeBencode(tt.input)
+				if err != nil {
+					t.Fatalf("DecodeBencode(%q): %v", tt.input, err)
+				}
+				data, err := MarshalBNodeLossless(&node, encoding)
+				if err != nil {
+					t.Fatalf("MarshalBNodeLossless(%q): %v", tt.input, err)
+				}
+
+				marker := tt.marker
+				if marker == "binary" {
+					marker = binaryMarker
+				}
+				if marker != "" && !strings.Contains(string(data), `{"`+marker+`":`) {
+					t.Errorf("JSON of %q = %s, want the %s marker", tt.input, data, marker)
+				}
+
+				back, err := UnmarshalBNodeLossless(data)
+				if err != nil {
+					t.Fatalf("UnmarshalBNodeLossless(%s): %v", data, err)
+				}
+				if encoded := EncodeBNode(back); string(encoded) != tt.input {
+					t.Errorf("round trip of %q through %s = %q", tt.input, data, encoded)
+				}
+			})
+		}
+	}
+
+	// A marker key is only ambiguous alone in its dictionary
+	node, _ := DecodeBencode("d4:$hex4:cafe1:xi1ee")
+	data, err := MarshalBNodeLossless(&node, BinaryHex)
+	if err != nil || string(data) != `{"$hex":"cafe","x":1}` {
+		t.Errorf("MarshalBNodeLossless of a marker key next to another key = %s, %v", data, err)
+	}
+}
+
+func TestUnmarshalBNodeLosslessRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// err is a part of the expected error message
+		err string
+	}{
+		{"invalid JSON", `{"a":`, "invalid JSON"},
+		{"two values", `1 2`, "data after value"},
+		{"float", `1.5`, "invalid integer"},
+		{"integer with leading zero", `[01]`, "invalid JSON"},
+		{"null", `null`, "unsupported JSON value"},
+		{"bool", `true`, "unsupported JSON value"},
+		{"invalid hex", `{"$hex":"zz"}`, "invalid $hex string"},
+		{"invalid base64", `{"$base64":"!"}`, "invalid $base64 string"},
+		{"hex marker not a string", `{"$hex":1}`, "$hex must be a string"},
+		{"dict marker not a list", `{"$dict":1}`, "must be a list of pairs"},
+		{"dict marker with a triple", `{"$dict":[["a",1,2]]}`, "must be a list of pairs"},
+		{"dict marker with an integer key", `{"$dict":[[1,2]]}`, "key must be a string"},
+		{"dict marker with a duplicate key", `{"$dict":[["a",1],[{"$hex":"61"},2]]}`, "duplicate dictionary key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := UnmarshalBNodeLossless([]byte(tt.input))
+			if err == nil {
+				t.Fatalf("UnmarshalBNodeLossless(%s) succeeded, want error %q", tt.input, tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("UnmarshalBNodeLossless(%s) error = %q, want %q", tt.input, err, tt.err)
+			}
+		})
+	}
+
+	_, err := MarshalBNodeLossless(&BNode{Type: BString}, "base32")
+	if err == nil {
+		t.Errorf("MarshalBNodeLossless with an unknown encoding succeeded")
+	}
+}
@@ -0,0 +1,462 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RawMessage is a raw bencoded value; It keeps the exact bytes of a value, like the `info` dictionary,
+// through Unmarshal and Marshal.
+type RawMessage []byte
+
+var (
+	rawMessageType = reflect.TypeOf(RawMessage(nil))
+	bnodeType      = reflect.TypeOf(BNode{})
+	bigIntType     = reflect.TypeOf(big.Int{})
+)
+
+// Marshal returns the bencoding of v.
+//
+// Strings and byte slices are encoded as strings, integers, big.Int and booleans as integers, slices and arrays as lists,
+// and maps with string keys and structs as dictionaries. Struct fields are named by their `bencode` tag, like
+// `bencode:"piece length,omitempty"`, or by the field name; A tag of "-" skips the field. The fields of embedded
+// structs without a tag are flattened, and two fields with the same key are an error.
+func Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := marshalValue(&buf, reflect.ValueOf(v))
+	if err != nil {
+		return nil, fmt.Errorf("bencode: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// bencodeWriter is the output of marshalValue, like a bytes.Buffer or a bufio.Writer.
+type bencodeWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// marshalValue writes the bencoding of v; Its errors have no "bencode:" prefix, so nested errors don't repeat it.
+func marshalValue(buf bencodeWriter, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("can't marshal nil value")
+	}
+
+	switch v.Type() {
+	case rawMessageType:
+		if v.Len() == 0 {
+			return fmt.Errorf("can't marshal empty RawMessage")
+		}
+		buf.Write(v.Bytes())
+		return nil
+	case bnodeType:
+		buf.Write(EncodeBNode(v.Interface().(BNode)))
+		return nil
+	case bigIntType:
+		i := v.Interface().(big.Int)
+		buf.WriteString("i" + i.String() + "e")
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		buf.Write(EncodeBencodeString(v.String()))
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteString("i" + strconv.FormatInt(v.Int(), 10) + "e")
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf.WriteString("i" + strconv.FormatUint(v.Uint(), 10) + "e")
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf.Write(EncodeBencodeString(string(bytesOf(v))))
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			err := marshalValue(buf, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map key type %s", v.Type().Key())
+		}
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('d')
+		for _, key := range keys {
+			buf.Write(EncodeBencodeString(key))
+			err := marshalValue(buf, v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())))
+			if err != nil {
+				return fmt.Errorf("key %q: %v", key, err)
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		fields, err := structFields(v.Type())
+		if err != nil {
+			return err
+		}
+		buf.WriteByte('d')
+		for _, field := range fields {
+			fieldValue := v.FieldByIndex(field.index)
+			if field.omitEmpty && isEmptyValue(fieldValue) {
+				continue
+			}
+			buf.Write(EncodeBencodeString(field.name))
+			err := marshalValue(buf, fieldValue)
+			if err != nil {
+				return fmt.Errorf("field %s: %v", field.name, err)
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("can't marshal nil %s", v.Type())
+		}
+		return marshalValue(buf, v.Elem())
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+// bytesOf returns the content of a byte slice or byte array.
+func bytesOf(v reflect.Value) []byte {
+	if v.Kind() == reflect.Slice {
+		return v.Bytes()
+	}
+	b := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(b), v)
+	return b
+}
+
+// isEmptyValue reports whether the value is left out by omitempty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+// structField is an exported struct field with its bencode key.
+type structField struct {
+	name string
+	// index is the path to the field through embedded structs, for reflect.Value.FieldByIndex
+	index     []int
+	omitEmpty bool
+}
+
+// structFields returns the fields of the struct type sorted by key, as bencode dictionaries must be.
+//
+// The fields of an embedded struct without a tag are flattened into the struct, like in encoding/json;
+// A field hides the fields with the same key deeper down. Two fields with the same key at the same
+// depth are an error, since the dictionary would have a duplicate key.
+func structFields(t reflect.Type) ([]structField, error) {
+	fields := make([]structField, 0, t.NumField())
+	// depths holds the depth of the field of each key
+	depths := make(map[string]int)
+	err := collectStructFields(t, nil, depths, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	return fields, nil
+}
+
+// collectStructFields adds the fields of the struct type at the index path to fields.
+func collectStructFields(t reflect.Type, index []int, depths map[string]int, fields *[]structField) error {
+	// The fields of this struct come before the embedded ones, so they hide them
+	embedded := make([]int, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, i)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		depth, ok := depths[name]
+		if ok && depth < len(index) {
+			continue
+		}
+		if ok {
+			return fmt.Errorf("duplicate key %q in %s", name, t)
+		}
+		depths[name] = len(index)
+
+		fieldIndex := append(append(make([]int, 0, len(index)+1), index...), i)
+		*fields = append(*fields, structField{name: name, index: fieldIndex, omitEmpty: options == "omitempty"})
+	}
+
+	for _, i := range embedded {
+		err := collectStructFields(t.Field(i).Type, append(append(make([]int, 0, len(index)+1), index...), i), depths, fields)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unmarshal parses the bencoded data and stores the result in the value pointed to by v.
+//
+// It follows the rules of Marshal. Dictionary keys without a matching field are ignored,
+// and fields without a matching key keep their value. Into an `any`, strings decode as string,
+// integers as int, or *big.Int if they don't fit, lists as []any and dictionaries as map[string]any.
+func Unmarshal(data []byte, v any) error {
+	return unmarshalBencode(data, v, false)
+}
+
+// UnmarshalLenient is Unmarshal, but accepts dictionaries with unsorted keys, which many clients send.
+func UnmarshalLenient(data []byte, v any) error {
+	return unmarshalBencode(data, v, true)
+}
+
+// unmarshalBencode is Unmarshal, optionally accepting unsorted dictionary keys.
+func unmarshalBencode(data []byte, v any, allowUnsortedKeys bool) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: Unmarshal needs a non-nil pointer, got %T", v)
+	}
+
+	node, err := decodeBencode(string(data), allowUnsortedKeys)
+	if err != nil {
+		return err
+	}
+	err = unmarshalNode(node, rv.Elem())
+	if err != nil {
+		return fmt.Errorf("bencode: %v", err)
+	}
+	return nil
+}
+
+// unmarshalNode stores the decoded value into v.
+func unmarshalNode(node BNode, v reflect.Value) error {
+	switch v.Type() {
+	case rawMessageType:
+		v.SetBytes([]byte(node.Raw))
+		return nil
+	case bnodeType:
+		v.Set(reflect.ValueOf(node))
+		return nil
+	case bigIntType:
+		if node.Type != BInt {
+			return fmt.Errorf("can't unmarshal %s into big.Int", bencodeTypeName(node.Type))
+		}
+		i := big.NewInt(int64(node.Int))
+		if node.BigInt != nil {
+			i.Set(node.BigInt)
+		}
+		v.Set(reflect.ValueOf(*i))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return unmarshalNode(node, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("can't unmarshal into %s", v.Type())
+		}
+		v.Set(reflect.ValueOf(bnodeToAny(node)))
+		return nil
+	}
+
+	switch node.Type {
+	case BInt:
+		return setInt(v, node)
+	case BString:
+		return setString(v, node.Str)
+	case BList:
+		return unmarshalList(node, v)
+	default:
+		return unmarshalDict(node, v)
+	}
+}
+
+// setInt stores a bencoded integer into an integer or bool value.
+func setInt(v reflect.Value, node BNode) error {
+	if node.BigInt != nil && v.Kind() != reflect.Bool {
+		// Unsigned integers go up to 2^64-1, past an int
+		isUint := v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64
+		if !isUint || !node.BigInt.IsUint64() || v.OverflowUint(node.BigInt.Uint64()) {
+			return fmt.Errorf("integer %s overflows %s", node.BigInt, v.Type())
+		}
+		v.SetUint(node.BigInt.Uint64())
+		return nil
+	}
+
+	i := node.Int
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(int64(i)) {
+			return fmt.Errorf("integer %d overflows %s", i, v.Type())
+		}
+		v.SetInt(int64(i))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i < 0 || v.OverflowUint(uint64(i)) {
+			return fmt.Errorf("integer %d overflows %s", i, v.Type())
+		}
+		v.SetUint(uint64(i))
+	case reflect.Bool:
+		// A BigInt is never zero
+		v.SetBool(i != 0 || node.BigInt != nil)
+	default:
+		return fmt.Errorf("can't unmarshal integer into %s", v.Type())
+	}
+	return nil
+}
+
+// bencodeTypeName returns the name of the bencode type for error messages.
+func bencodeTypeName(t BType) string {
+	switch t {
+	case BString:
+		return "string"
+	case BInt:
+		return "integer"
+	case BList:
+		return "list"
+	default:
+		return "dictionary"
+	}
+}
+
+// setString stores a bencoded string into a string, byte slice or byte array value.
+func setString(v reflect.Value, str string) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(str)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes([]byte(str))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(str) != v.Len() {
+			return fmt.Errorf("string of length %d doesn't fit %s", len(str), v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf([]byte(str)))
+	default:
+		return fmt.Errorf("can't unmarshal string into %s", v.Type())
+	}
+	return nil
+}
+
+// unmarshalList stores a decoded list into a slice value.
+func unmarshalList(node BNode, v reflect.Value) error {
+	if v.Kind() != reflect.Slice {
+		return fmt.Errorf("can't unmarshal list into %s", v.Type())
+	}
+
+	list := reflect.MakeSlice(v.Type(), len(node.List), len(node.List))
+	for i, item := range node.List {
+		err := unmarshalNode(*item, list.Index(i))
+		if err != nil {
+			return fmt.Errorf("item %d: %v", i, err)
+		}
+	}
+
+	v.Set(list)
+	return nil
+}
+
+// unmarshalDict stores a decoded dictionary into a struct or map value.
+func unmarshalDict(node BNode, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		fields, err := structFields(v.Type())
+		if err != nil {
+			return err
+		}
+		for _, field := range fields {
+			item, ok := node.Dict[field.name]
+			if !ok {
+				continue
+			}
+			err := unmarshalNode(*item, v.FieldByIndex(field.index))
+			if err != nil {
+				return fmt.Errorf("field %s: %v", field.name, err)
+			}
+		}
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map key type %s", v.Type().Key())
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for key, item := range node.Dict {
+			value := reflect.New(v.Type().Elem()).Elem()
+			err := unmarshalNode(*item, value)
+			if err != nil {
+				return fmt.Errorf("key %q: %v", key, err)
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), value)
+		}
+
+	default:
+		return fmt.Errorf("can't unmarshal dictionary into %s", v.Type())
+	}
+
+	return nil
+}
+
+// bnodeToAny converts a BNode to plain Go values.
+func bnodeToAny(node BNode) any {
+	switch node.Type {
+	case BString:
+		return node.Str
+	case BInt:
+		if node.BigInt != nil {
+			return node.BigInt
+		}
+		return node.Int
+	case BList:
+		list := make([]any, 0, len(node.List))
+		for _, item := range node.List {
+			list = append(list, bnodeToAny(*item))
+		}
+		return list
+	default:
+		dict := make(map[string]any, len(node.Dict))
+		for key, value := range node.Dict {
+			dict[key] = bnodeToAny(*value)
+		}
+		return dict
+	}
+}
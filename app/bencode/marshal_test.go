@@ -0,0 +1,355 @@
+package bencode
+
+import (
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tagged has fields named by tags, skipped and left out when empty.
+type tagged struct {
+	PieceLength int    `bencode:"piece length"`
+	Name        string `bencode:"name"`
+	Comment     string `bencode:"comment,omitempty"`
+	Skipped     string `bencode:"-"`
+	Untagged    int
+	private     int
+}
+
+// fileInfo is embedded in other test structs.
+type fileInfo struct {
+	Length int    `bencode:"length"`
+	Name   string `bencode:"name"`
+}
+
+// embedding flattens the fields of fileInfo; Its own name hides the one of fileInfo.
+type embedding struct {
+	fileInfo
+	Name    string `bencode:"name"`
+	Private bool   `bencode:"private"`
+}
+
+// withPointers has optional fields, which are nil when the key is missing.
+type withPointers struct {
+	Length *int    `bencode:"length,omitempty"`
+	Name   *string `bencode:"name,omitempty"`
+	Tags   *[]string
+}
+
+// withRaw keeps the info dictionary as is.
+type withRaw struct {
+	Announce string     `bencode:"announce"`
+	Info     RawMessage `bencode:"info"`
+}
+
+// duplicateKeys has two fields with the same key.
+type duplicateKeys struct {
+	A int `bencode:"key"`
+	B int `bencode:"key"`
+}
+
+// duplicateEmbedded has two embedded structs with the same key at the same depth.
+type duplicateEmbedded struct {
+	fileInfo
+	other
+}
+
+type other struct {
+	Length int `bencode:"length"`
+}
+
+func TestMarshal(t *testing.T) {
+	length := 42
+	name := "a.txt"
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"string", "spam", "4:spam"},
+		{"negative int", -42, "i-42e"},
+		{"uint", uint8(200), "i200e"},
+		{"bool", true, "i1e"},
+		{"byte slice", []byte{0, 0xff}, "2:\x00\xff"},
+		{"byte array", [3]byte{'a', 'b', 'c'}, "3:abc"},
+		{"list", []any{"a", 1, []int{2}}, "l1:ai1eli2eee"},
+		{"map with sorted keys", map[string]int{"b": 2, "a": 1}, "d1:ai1e1:bi2ee"},
+		{"struct tags", tagged{PieceLength: 16384, Name: "x", Skipped: "y", Untagged: 1, private: 2}, "d8:Untaggedi1e4:name1:x12:piece lengthi16384ee"},
+		{"omitempty with a value", tagged{Comment: "c"}, "d8:Untaggedi0e7:comment1:c4:name0:12:piece lengthi0ee"},
+		{"embedded struct", embedding{fileInfo: fileInfo{Length: 3, Name: "hidden"}, Name: "outer"}, "d6:lengthi3e4:name5:outer7:privatei0ee"},
+		{"nil pointers omitted", withPointers{Tags: &[]string{}}, "d4:Tagslee"},
+		{"pointer fields", withPointers{Length: &length, Name: &name, Tags: &[]string{"t"}}, "d4:Tagsl1:te6:lengthi42e4:name5:a.txte"},
+		{"pointer to struct", &fileInfo{Length: 1, Name: "n"}, "d6:lengthi1e4:name1:ne"},
+		{"raw message", withRaw{Announce: "u", Info: RawMessage("d1:bi1e1:ai2ee")}, "d8:announce1:u4:infod1:bi1e1:ai2eee"},
+		{"bnode", BNode{Type: BList, List: []*BNode{{Type: BInt, Int: 7}}}, "li7ee"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.value)
+			if err != nil {
+				t.Fatalf("Marshal(%#v): %v", tt.value, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Marshal(%#v) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		// err is a part of the expected error message
+		err string
+	}{
+		{"nil", nil, "can't marshal nil value"},
+		{"nil pointer field", withPointers{}, "field Tags: can't marshal nil *[]string"},
+		{"empty raw message", withRaw{}, "field info: can't marshal empty RawMessage"},
+		{"duplicate keys", duplicateKeys{}, `duplicate key "key"`},
+		{"duplicate embedded keys", duplicateEmbedded{}, `duplicate key "length"`},
+		{"map with int keys", map[int]string{1: "a"}, "unsupported map key type int"},
+		{"unsupported type", make(chan int), "unsupported type chan int"},
+		{"float", 1.5, "unsupported type float64"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Marshal(tt.value)
+			if err == nil {
+				t.Fatalf("Marshal(%#v) succeeded, want error %q", tt.value, tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Marshal(%#v) error = %q, want %q", tt.value, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	length := 42
+	name := "a.txt"
+	tests := []struct {
+		name  string
+		input string
+		// into returns a pointer to the zero value to decode into
+		into func() any
+		want any
+	}{
+		{"string", "4:spam", func() any { return new(string) }, "spam"},
+		{"int", "i-42e", func() any { return new(int) }, -42},
+		{"bool", "i1e", func() any { return new(bool) }, true},
+		{"byte slice", "2:\x00\xff", func() any { return new([]byte) }, []byte{0, 0xff}},
+		{"byte array", "3:abc", func() any { return new([3]byte) }, [3]byte{'a', 'b', 'c'}},
+		{"list", "li1ei2ee", func() any { return new([]int) }, []int{1, 2}},
+		{"map", "d1:ai1e1:bi2ee", func() any { return new(map[string]int) }, map[string]int{"a": 1, "b": 2}},
+		{"any", "d1:ali1e1:xee", func() any { return new(any) }, map[string]any{"a": []any{1, "x"}}},
+		{"struct tags", "d7:Skipped1:y8:Untaggedi1e4:name1:x12:piece lengthi16384e7:unknowni0ee", func() any { return new(tagged) },
+			tagged{PieceLength: 16384, Name: "x", Untagged: 1}},
+		{"embedded struct", "d6:lengthi3e4:name5:outer7:privatei1ee", func() any { return new(embedding) },
+			embedding{fileInfo: fileInfo{Length: 3}, Name: "outer", Private: true}},
+		{"missing pointer fields stay nil", "de", func() any { return new(withPointers) }, withPointers{}},
+		{"pointer fields", "d4:Tagsl1:te6:lengthi42e4:name5:a.txte", func() any { return new(withPointers) },
+			withPointers{Length: &length, Name: &name, Tags: &[]string{"t"}}},
+		{"list of structs", "ld6:lengthi1eed4:name1:nee", func() any { return new([]fileInfo) },
+			[]fileInfo{{Length: 1}, {Name: "n"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := tt.into()
+			err := Unmarshal([]byte(tt.input), v)
+			if err != nil {
+				t.Fatalf("Unmarshal(%q): %v", tt.input, err)
+			}
+			got := reflect.ValueOf(v).Elem().Interface()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unmarshal(%q) = %#v, want %#v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		into  any
+		// err is a part of the expected error message
+		err string
+	}{
+		{"not a pointer", "i1e", 0, "needs a non-nil pointer"},
+		{"nil pointer", "i1e", (*int)(nil), "needs a non-nil pointer"},
+		{"invalid bencode", "i1", new(int), "unterminated number"},
+		{"string into int", "4:spam", new(int), "can't unmarshal string into int"},
+		{"int into string", "i1e", new(string), "can't unmarshal integer into string"},
+		{"list into struct", "le", new(fileInfo), "can't unmarshal list into bencode.fileInfo"},
+		{"dictionary into slice", "de", new([]int), "can't unmarshal dictionary into []int"},
+		{"field type mismatch", "d6:length1:xe", new(fileInfo), "field length: can't unmarshal string into int"},
+		{"list item type mismatch", "li1e1:xe", new([]int), "item 1: can't unmarshal string into int"},
+		{"map value type mismatch", "d1:a1:xe", new(map[string]int), `key "a": can't unmarshal string into int`},
+		{"overflow", "i300e", new(int8), "integer 300 overflows int8"},
+		{"negative into uint", "i-1e", new(uint), "integer -1 overflows uint"},
+		{"byte array length", "2:ab", new([3]byte), "string of length 2 doesn't fit [3]uint8"},
+		{"interface with methods", "i1e", new(error), "can't unmarshal into error"},
+		{"duplicate keys", "de", new(duplicateKeys), `duplicate key "key"`},
+		{"unsorted keys", "d1:bi1e1:ai2ee", new(map[string]int), "not sorted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Unmarshal([]byte(tt.input), tt.into)
+			if err == nil {
+				t.Fatalf("Unmarshal(%q) into %T succeeded, want error %q", tt.input, tt.into, tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Unmarshal(%q) into %T error = %q, want %q", tt.input, tt.into, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRawMessagePreservesBytes(t *testing.T) {
+	// The info dictionary has unsorted keys, as some torrent files do; Its hash depends on the exact bytes
+	input := "d8:announce1:u4:infod6:lengthi3e4:name1:a1:Ai1eee"
+	var v withRaw
+	err := UnmarshalLenient([]byte(input), &v)
+	if err != nil {
+		t.Fatalf("UnmarshalLenient(%q): %v", input, err)
+	}
+	want := "d6:lengthi3e4:name1:a1:Ai1ee"
+	if string(v.Info) != want {
+		t.Errorf("Info = %q, want %q", v.Info, want)
+	}
+
+	encoded, err := Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if string(encoded) != input {
+		t.Errorf("Marshal(UnmarshalLenient(%q)) = %q", input, encoded)
+	}
+
+	// The strict Unmarshal rejects the unsorted keys, even inside a RawMessage
+	err = Unmarshal([]byte(input), &v)
+	if err == nil || !strings.Contains(err.Error(), "not sorted") {
+		t.Errorf("Unmarshal of unsorted keys in a RawMessage: error = %v", err)
+	}
+}
+
+// withBigInt has an integer field which may not fit an int64.
+type withBigInt struct {
+	Size *big.Int `bencode:"size"`
+}
+
+func TestBigInt(t *testing.T) {
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	negative := new(big.Int).Neg(huge)
+
+	tests := []struct {
+		name  string
+		input string
+		want  *big.Int
+	}{
+		{"huge", "i123456789012345678901234567890e", huge},
+		{"huge negative", "i-123456789012345678901234567890e", negative},
+		{"small", "i42e", big.NewInt(42)},
+		{"max int64", "i9223372036854775807e", big.NewInt(9223372036854775807)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var i big.Int
+			err := Unmarshal([]byte(tt.input), &i)
+			if err != nil {
+				t.Fatalf("Unmarshal(%q) into big.Int: %v", tt.input, err)
+			}
+			if i.Cmp(tt.want) != 0 {
+				t.Errorf("Unmarshal(%q) = %s, want %s", tt.input, &i, tt.want)
+			}
+
+			// A *big.Int field is allocated, and encodes back to the same bytes
+			input := "d4:size" + tt.input + "e"
+			var v withBigInt
+			err = Unmarshal([]byte(input), &v)
+			if err != nil {
+				t.Fatalf("Unmarshal(%q) into a *big.Int field: %v", input, err)
+			}
+			if v.Size == nil || v.Size.Cmp(tt.want) != 0 {
+				t.Errorf("Unmarshal(%q).Size = %v, want %s", input, v.Size, tt.want)
+			}
+			encoded, err := Marshal(v)
+			if err != nil {
+				t.Fatalf("Marshal(%v): %v", v, err)
+			}
+			if string(encoded) != input {
+				t.Errorf("Marshal(Unmarshal(%q)) = %q", input, encoded)
+			}
+		})
+	}
+
+	// Into an any, integers which don't fit an int are a *big.Int
+	var v any
+	err := Unmarshal([]byte("i123456789012345678901234567890e"), &v)
+	if err != nil {
+		t.Fatalf("Unmarshal into any: %v", err)
+	}
+	if i, ok := v.(*big.Int); !ok || i.Cmp(huge) != 0 {
+		t.Errorf("Unmarshal into any = %#v, want *big.Int %s", v, huge)
+	}
+
+	encoded, err := Marshal(*negative)
+	if err != nil || string(encoded) != "i-123456789012345678901234567890e" {
+		t.Errorf("Marshal(big.Int) = %q, %v", encoded, err)
+	}
+}
+
+func TestBigIntOverflow(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		into  any
+		// err is a part of the expected error message
+		err string
+	}{
+		{"into int", "i123456789012345678901234567890e", new(int), "integer 123456789012345678901234567890 overflows int"},
+		{"negative into int", "i-123456789012345678901234567890e", new(int), "integer -123456789012345678901234567890 overflows int"},
+		{"max int64 + 1 into int64", "i9223372036854775808e", new(int64), "integer 9223372036854775808 overflows int64"},
+		{"into uint64", "i18446744073709551616e", new(uint64), "overflows uint64"},
+		{"past uint32", "i18446744073709551615e", new(uint32), "overflows uint32"},
+		{"into a field", "d6:lengthi123456789012345678901234567890ee", new(fileInfo), "field length: integer 123456789012345678901234567890 overflows int"},
+		{"string into big.Int", "4:spam", new(big.Int), "can't unmarshal string into big.Int"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Unmarshal([]byte(tt.input), tt.into)
+			if err == nil {
+				t.Fatalf("Unmarshal(%q) into %T succeeded, want error %q", tt.input, tt.into, tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Unmarshal(%q) into %T error = %q, want %q", tt.input, tt.into, err, tt.err)
+			}
+		})
+	}
+
+	// The smallest int64 still fits
+	var i int64
+	err := Unmarshal([]byte("i-9223372036854775808e"), &i)
+	if err != nil || i != -9223372036854775808 {
+		t.Errorf("Unmarshal of the smallest int64 = %d, %v", i, err)
+	}
+
+	// The largest uint64 doesn't fit an int, but fits a uint64
+	var u uint64
+	err = Unmarshal([]byte("i18446744073709551615e"), &u)
+	if err != nil || u != 18446744073709551615 {
+		t.Errorf("Unmarshal of the largest uint64 = %d, %v", u, err)
+	}
+	encoded, err := Marshal(u)
+	if err != nil || string(encoded) != "i18446744073709551615e" {
+		t.Errorf("Marshal of the largest uint64 = %q, %v", encoded, err)
+	}
+}
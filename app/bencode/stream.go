@@ -0,0 +1,235 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// maxDecodeDepth is the deepest nesting of lists and dictionaries the Decoder accepts.
+const maxDecodeDepth = 512
+
+// maxDecodeStringLength is the longest string the Decoder accepts, so a bogus length can't exhaust memory.
+const maxDecodeStringLength = 64 * 1024 * 1024
+
+// byteScanReader is a reader which can peek at the next byte.
+type byteScanReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+// Decoder reads bencoded values one at a time from an input stream.
+// It reads only as much input as needed for each value; Buffered returns the data read ahead.
+type Decoder struct {
+	r byteScanReader
+	// buffered is the buffer the Decoder added over the input, if any
+	buffered *bufio.Reader
+	offset   int
+	// allowUnsortedKeys is set by AllowUnsortedKeys
+	allowUnsortedKeys bool
+}
+
+// NewDecoder returns a Decoder reading from r. If r is not an io.ByteScanner, like a bufio.Reader
+// or bytes.Reader, it is buffered, and the Decoder may read more than the values it returns.
+func NewDecoder(r io.Reader) *Decoder {
+	if scanner, ok := r.(byteScanReader); ok {
+		return &Decoder{r: scanner}
+	}
+	buffered := bufio.NewReader(r)
+	return &Decoder{r: buffered, buffered: buffered}
+}
+
+// Decode reads the next value and stores it in the value pointed to by v, like Unmarshal.
+// It returns io.EOF when the input ends before a new value.
+func (d *Decoder) Decode(v any) error {
+	start := d.offset
+	raw, err := d.readRaw()
+	if err != nil {
+		return err
+	}
+	return shiftDecodeError(unmarshalBencode(raw, v, d.allowUnsortedKeys), start)
+}
+
+// ReadRaw reads and validates the next value, and returns its bencoded bytes.
+func (d *Decoder) ReadRaw() (RawMessage, error) {
+	start := d.offset
+	raw, err := d.readRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = decodeBencode(string(raw), d.allowUnsortedKeys)
+	if err != nil {
+		return nil, shiftDecodeError(err, start)
+	}
+	return raw, nil
+}
+
+// readRaw reads the bytes of the next value; Only the structure of the value is checked.
+func (d *Decoder) readRaw() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.readValue(&buf, 0)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// shiftDecodeError makes the offset of a DecodeError in a value relative to the whole input.
+func shiftDecodeError(err error, start int) error {
+	if decodeErr, ok := err.(*DecodeError); ok {
+		return &DecodeError{Offset: start + decodeErr.Offset, Msg: decodeErr.Msg}
+	}
+	return err
+}
+
+// AllowUnsortedKeys makes the Decoder accept dictionaries with keys out of order; Duplicate keys are still an error.
+// The Raw bytes of the decoded nodes keep the original order.
+func (d *Decoder) AllowUnsortedKeys() {
+	d.allowUnsortedKeys = true
+}
+
+// InputOffset returns the number of bytes of the input consumed by the Decoder.
+func (d *Decoder) InputOffset() int {
+	return d.offset
+}
+
+// Buffered returns the data read from the input but not consumed by the Decoder yet.
+func (d *Decoder) Buffered() io.Reader {
+	if d.buffered == nil {
+		return bytes.NewReader(nil)
+	}
+	data, _ := d.buffered.Peek(d.buffered.Buffered())
+	return bytes.NewReader(data)
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	d.offset++
+	return c, nil
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	return c, d.r.UnreadByte()
+}
+
+// readValue copies the next value to buf, checking its structure on the way.
+func (d *Decoder) readValue(buf *bytes.Buffer, depth int) error {
+	if depth > maxDecodeDepth {
+		return &DecodeError{Offset: d.offset, Msg: "nesting too deep"}
+	}
+
+	start := d.offset
+	c, err := d.readByte()
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(c)
+
+	switch {
+	case c == 'i':
+		for {
+			c, err = d.readByte()
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(c)
+			if c == 'e' {
+				return nil
+			}
+			if (c < '0' || c > '9') && c != '-' {
+				return &DecodeError{Offset: start, Msg: "invalid integer"}
+			}
+		}
+
+	case c == 'l' || c == 'd':
+		// In dictionaries, every even item is a key
+		for item := 0; ; item++ {
+			next, err := d.peekByte()
+			if err != nil {
+				return err
+			}
+			if next == 'e' && (c == 'l' || item%2 == 0) {
+				d.readByte()
+				buf.WriteByte('e')
+				return nil
+			}
+			if c == 'd' && item%2 == 0 && (next < '0' || next > '9') {
+				return &DecodeError{Offset: d.offset, Msg: "dictionary key is not a string"}
+			}
+			err = d.readValue(buf, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+
+	case c >= '0' && c <= '9':
+		lengthStr := []byte{c}
+		for {
+			c, err = d.readByte()
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(c)
+			if c == ':' {
+				break
+			}
+			if c < '0' || c > '9' || len(lengthStr) > 10 {
+				return &DecodeError{Offset: start, Msg: "invalid string length"}
+			}
+			lengthStr = append(lengthStr, c)
+		}
+
+		length, err := strconv.Atoi(string(lengthStr))
+		if err != nil || length > maxDecodeStringLength {
+			return &DecodeError{Offset: start, Msg: "invalid string length"}
+		}
+		n, err := io.CopyN(buf, d.r, int64(length))
+		d.offset += int(n)
+		return err
+
+	default:
+		return &DecodeError{Offset: start, Msg: fmt.Sprintf("unknown bencoded value %q", c)}
+	}
+}
+
+// Encoder writes bencoded values to an output stream.
+type Encoder struct {
+	out io.Writer
+	w   *bufio.Writer
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{out: w, w: bufio.NewWriter(w)}
+}
+
+// Encode writes the bencoding of v, like Marshal, as it goes through v.
+// On error, the part of the value before the error may already be written.
+func (e *Encoder) Encode(v any) error {
+	err := marshalValue(e.w, reflect.ValueOf(v))
+	if err != nil {
+		// Drop what is still buffered, so the next value doesn't follow a partial one
+		e.w.Reset(e.out)
+		return fmt.Errorf("bencode: %v", err)
+	}
+	return e.w.Flush()
+}
@@ -0,0 +1,193 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecoderStream(t *testing.T) {
+	input := "i1e4:spamli2eed1:ai1ee"
+	// A reader without ReadByte gets buffered by the Decoder
+	d := NewDecoder(iotest.OneByteReader(strings.NewReader(input)))
+
+	want := []struct {
+		value  any
+		offset int
+	}{
+		{1, 3},
+		{"spam", 9},
+		{[]any{2}, 14},
+		{map[string]any{"a": 1}, len(input)},
+	}
+	for i, w := range want {
+		var v any
+		err := d.Decode(&v)
+		if err != nil {
+			t.Fatalf("Decode of value %d: %v", i, err)
+		}
+		if fmt.Sprint(v) != fmt.Sprint(w.value) {
+			t.Errorf("value %d = %v, want %v", i, v, w.value)
+		}
+		if d.InputOffset() != w.offset {
+			t.Errorf("InputOffset after value %d = %d, want %d", i, d.InputOffset(), w.offset)
+		}
+	}
+
+	var v any
+	err := d.Decode(&v)
+	if err != io.EOF {
+		t.Errorf("Decode at the end of the input: error = %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderReadsOnlyTheValue(t *testing.T) {
+	// A bytes.Reader can peek, so the Decoder leaves the data after the value in it
+	r := bytes.NewReader([]byte("4:spamtrailing data"))
+	d := NewDecoder(r)
+	raw, err := d.ReadRaw()
+	if err != nil {
+		t.Fatalf("ReadRaw: %v", err)
+	}
+	if string(raw) != "4:spam" {
+		t.Errorf("ReadRaw = %q, want %q", raw, "4:spam")
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "trailing data" {
+		t.Errorf("left in the reader: %q, want %q", rest, "trailing data")
+	}
+
+	// Over a buffered reader, the data read ahead is in Buffered
+	d = NewDecoder(iotest.OneByteReader(strings.NewReader("i1ei2e")))
+	_, err = d.ReadRaw()
+	if err != nil {
+		t.Fatalf("ReadRaw: %v", err)
+	}
+	buffered, _ := io.ReadAll(d.Buffered())
+	if !strings.HasPrefix("i2e", string(buffered)) {
+		t.Errorf("Buffered = %q, want a prefix of %q", buffered, "i2e")
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// err is a part of the expected error message
+		err string
+	}{
+		{"truncated value", "i1ei2", "unexpected EOF"},
+		{"truncated string", "i1e5:spam", "unexpected EOF"},
+		{"string longer than the limit", fmt.Sprintf("i1e%d:spam", maxDecodeStringLength+1), "invalid string length"},
+		{"string length overflow", "i1e99999999999999999999:", "invalid string length"},
+		{"nesting too deep", "i1e" + strings.Repeat("l", maxDecodeDepth+2), "nesting too deep"},
+		{"invalid second value", "i1ei03e", "leading zero"},
+		{"unsorted keys", "i1ed1:bi1e1:ai2ee", "not sorted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(tt.input))
+			var first int
+			err := d.Decode(&first)
+			if err != nil {
+				t.Fatalf("Decode of the first value: %v", err)
+			}
+
+			var v any
+			err = d.Decode(&v)
+			if err == nil {
+				t.Fatalf("Decode(%q) succeeded, want error %q", tt.input, tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Decode(%q) error = %q, want %q", tt.input, err, tt.err)
+			}
+			// The offsets of errors are in the whole input
+			var decodeErr *DecodeError
+			if errors.As(err, &decodeErr) && decodeErr.Offset < 3 {
+				t.Errorf("Decode(%q) error offset = %d, want at least 3", tt.input, decodeErr.Offset)
+			}
+		})
+	}
+}
+
+func TestDecoderAllowUnsortedKeys(t *testing.T) {
+	input := "d1:bi1e1:ai2ee"
+	d := NewDecoder(strings.NewReader(input + input))
+	d.AllowUnsortedKeys()
+
+	var m map[string]int
+	err := d.Decode(&m)
+	if err != nil {
+		t.Fatalf("Decode with unsorted keys: %v", err)
+	}
+	if m["a"] != 2 || m["b"] != 1 {
+		t.Errorf("Decode = %v, want map[a:2 b:1]", m)
+	}
+
+	// The raw bytes keep the original order
+	raw, err := d.ReadRaw()
+	if err != nil {
+		t.Fatalf("ReadRaw with unsorted keys: %v", err)
+	}
+	if string(raw) != input {
+		t.Errorf("ReadRaw = %q, want %q", raw, input)
+	}
+
+	d = NewDecoder(strings.NewReader("d1:bi1e1:ai2e1:bi3ee"))
+	d.AllowUnsortedKeys()
+	err = d.Decode(&m)
+	if err == nil || !strings.Contains(err.Error(), "duplicate dictionary key") {
+		t.Errorf("Decode with duplicate unsorted keys: error = %v", err)
+	}
+}
+
+// countingWriter records each write, so tests can see when the Encoder flushes.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestEncoder(t *testing.T) {
+	var w countingWriter
+	e := NewEncoder(&w)
+
+	err := e.Encode(map[string]any{"a": []int{1, 2}})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// Each value is flushed as soon as it is encoded
+	if w.String() != "d1:ali1ei2eee" || w.writes != 1 {
+		t.Errorf("after Encode, the writer has %q in %d writes, want %q in 1", w.String(), w.writes, "d1:ali1ei2eee")
+	}
+
+	// A value which fails half way leaves nothing behind
+	err = e.Encode([]any{1, make(chan int)})
+	if err == nil || !strings.Contains(err.Error(), "unsupported type chan int") {
+		t.Fatalf("Encode of a channel: error = %v", err)
+	}
+	err = e.Encode("x")
+	if err != nil {
+		t.Fatalf("Encode after an error: %v", err)
+	}
+	if w.String() != "d1:ali1ei2eee1:x" {
+		t.Errorf("writer has %q, want %q", w.String(), "d1:ali1ei2eee1:x")
+	}
+
+	// What the Encoder writes, the Decoder reads back value by value
+	d := NewDecoder(&w.Buffer)
+	var first map[string][]int
+	var second string
+	if d.Decode(&first) != nil || d.Decode(&second) != nil || len(first["a"]) != 2 || second != "x" {
+		t.Errorf("decoded %v and %q from the Encoder output", first, second)
+	}
+}
@@ -0,0 +1,27 @@
+package bencode
+
+import "math/big"
+
+// BType defines the type of value stored in BNode.
+type BType int
+
+const (
+	BString BType = iota
+	BInt
+	BList
+	BDict
+)
+
+// BNode represents a self-referencing structure to hold Bencode values.
+type BNode struct {
+	Type BType
+	Str  string
+	Int  int
+	// BigInt is set instead of Int for integers which don't fit an int
+	BigInt *big.Int
+	List   []*BNode
+	Dict   map[string]*BNode
+	// Raw holds the exact bencoded bytes the node was decoded from; It is empty for nodes built in code.
+	// EncodeBNode ignores it, so a modified node is always encoded from its fields.
+	Raw string
+}
@@ -0,0 +1,249 @@
+package app
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// DefaultCreatePieceLength is the piece length used by the `create` command when none is given.
+const DefaultCreatePieceLength = 256 * 1024
+
+// CreateOptions holds the optional fields of a torrent created by CreateTorrent.
+type CreateOptions struct {
+	PieceLength int
+	// Announce is the main tracker URL; It defaults to the first tracker of AnnounceList
+	Announce     string
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	// CreationDate is left out of the torrent when zero, so the output is reproducible
+	CreationDate time.Time
+	Private      bool
+	// WebSeeds are HTTP/FTP URLs serving the same data, written as `url-list` (BEP 19)
+	WebSeeds []string
+}
+
+// CreateTorrent hashes the file or directory at root and returns the metainfo dictionary of the torrent.
+// The files of a directory are added in lexical order of their paths, empty directories are skipped.
+// Symbolic links to files are followed; Other links, like the ones to directories, are skipped and logged.
+// Names which other clients would reject, like ones with a backslash, are an error.
+func CreateTorrent(root string, opts CreateOptions) (bencode.BNode, error) {
+	if opts.PieceLength <= 0 {
+		return bencode.BNode{}, fmt.Errorf("invalid piece length: %d", opts.PieceLength)
+	}
+
+	stat, err := os.Stat(root)
+	if err != nil {
+		return bencode.BNode{}, fmt.Errorf("failed to stat %s: %v", root, err)
+	}
+
+	// The absolute path names `.` and `dir/..` after the actual directory
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return bencode.BNode{}, err
+	}
+	name := filepath.Base(absRoot)
+	if !isSafePathComponent(name) {
+		return bencode.BNode{}, fmt.Errorf("can't name a torrent after %s", absRoot)
+	}
+
+	info := bencode.BNode{Type: bencode.BDict, Dict: map[string]*bencode.BNode{
+		"name":         {Type: bencode.BString, Str: name},
+		"piece length": {Type: bencode.BInt, Int: opts.PieceLength},
+	}}
+	if opts.Private {
+		info.Dict["private"] = &bencode.BNode{Type: bencode.BInt, Int: 1}
+	}
+
+	hasher := newPieceHasher(opts.PieceLength)
+	if stat.IsDir() {
+		files, err := hashDirectory(root, hasher)
+		if err != nil {
+			return bencode.BNode{}, err
+		}
+		info.Dict["files"] = files
+	} else {
+		length, err := hashFile(root, hasher)
+		if err != nil {
+			return bencode.BNode{}, err
+		}
+		info.Dict["length"] = &bencode.BNode{Type: bencode.BInt, Int: length}
+	}
+	info.Dict["pieces"] = &bencode.BNode{Type: bencode.BString, Str: string(hasher.Sum())}
+
+	return newTorrentDict(info, opts), nil
+}
+
+// newTorrentDict wraps the info dictionary with the trackers and the other optional fields.
+func newTorrentDict(info bencode.BNode, opts CreateOptions) bencode.BNode {
+	torrent := bencode.BNode{Type: bencode.BDict, Dict: map[string]*bencode.BNode{"info": &info}}
+
+	announce := opts.Announce
+	if announce == "" && len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		announce = opts.AnnounceList[0][0]
+	}
+	if announce != "" {
+		torrent.Dict["announce"] = &bencode.BNode{Type: bencode.BString, Str: announce}
+	}
+	if len(opts.AnnounceList) > 0 {
+		tiers := bencode.BNode{Type: bencode.BList, List: make([]*bencode.BNode, 0, len(opts.AnnounceList))}
+		for _, tier := range opts.AnnounceList {
+			tiers.List = append(tiers.List, newStringList(tier))
+		}
+		torrent.Dict["announce-list"] = &tiers
+	}
+	if len(opts.WebSeeds) > 0 {
+		torrent.Dict["url-list"] = newStringList(opts.WebSeeds)
+	}
+	if opts.Comment != "" {
+		torrent.Dict["comment"] = &bencode.BNode{Type: bencode.BString, Str: opts.Comment}
+	}
+	if opts.CreatedBy != "" {
+		torrent.Dict["created by"] = &bencode.BNode{Type: bencode.BString, Str: opts.CreatedBy}
+	}
+	if !opts.CreationDate.IsZero() {
+		torrent.Dict["creation date"] = &bencode.BNode{Type: bencode.BInt, Int: int(opts.CreationDate.Unix())}
+	}
+
+	return torrent
+}
+
+// newStringList returns a bencode list of strings.
+func newStringList(items []string) *bencode.BNode {
+	list := &bencode.BNode{Type: bencode.BList, List: make([]*bencode.BNode, 0, len(items))}
+	for _, item := range items {
+		list.List = append(list.List, &bencode.BNode{Type: bencode.BString, Str: item})
+	}
+	return list
+}
+
+// WriteTorrentFile writes the metainfo dictionary returned by CreateTorrent to a `.torrent` file.
+func WriteTorrentFile(path string, torrent bencode.BNode) error {
+	err := os.WriteFile(path, bencode.EncodeBNode(torrent), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write torrent file: %v", err)
+	}
+	return nil
+}
+
+// hashDirectory feeds the regular files under root to the hasher, and returns the `files` list of the torrent.
+func hashDirectory(root string, hasher *pieceHasher) (*bencode.BNode, error) {
+	files := &bencode.BNode{Type: bencode.BList, List: make([]*bencode.BNode, 0)}
+
+	// WalkDir doesn't walk into a root which is a link to a directory
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %v", root, err)
+	}
+
+	// WalkDir visits the entries in lexical order, so the torrent doesn't depend on the filesystem
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			// Links to directories could loop, so only the ones to regular files are followed
+			target, err := os.Stat(path)
+			if err != nil || !target.Mode().IsRegular() {
+				log.Printf("Skipping symbolic link %s: not a regular file", path)
+				return nil
+			}
+		} else if !d.Type().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		// Clients reject the whole torrent if a name could escape the torrent directory on some system
+		components := strings.Split(filepath.ToSlash(relPath), "/")
+		for _, component := range components {
+			if !isSafePathComponent(component) {
+				return fmt.Errorf("%s: name %q can't be used in a torrent", path, component)
+			}
+		}
+		length, err := hashFile(path, hasher)
+		if err != nil {
+			return err
+		}
+
+		files.List = append(files.List, &bencode.BNode{Type: bencode.BDict, Dict: map[string]*bencode.BNode{
+			"length": {Type: bencode.BInt, Int: length},
+			"path":   newStringList(components),
+		}})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %v", root, err)
+	}
+	if len(files.List) == 0 {
+		return nil, fmt.Errorf("directory %s has no files", root)
+	}
+
+	return files, nil
+}
+
+// hashFile feeds the content of the file to the hasher and returns its length.
+func hashFile(path string, hasher *pieceHasher) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	n, err := io.Copy(hasher, file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read file %s: %v", path, err)
+	}
+	return int(n), nil
+}
+
+// pieceHasher splits the data written to it into pieces and hashes them; Pieces span file boundaries.
+type pieceHasher struct {
+	pieceLength int
+	buffer      []byte
+	pieces      []byte
+}
+
+func newPieceHasher(pieceLength int) *pieceHasher {
+	return &pieceHasher{pieceLength: pieceLength, buffer: make([]byte, 0, pieceLength)}
+}
+
+func (h *pieceHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := min(len(p), h.pieceLength-len(h.buffer))
+		h.buffer = append(h.buffer, p[:n]...)
+		p = p[n:]
+
+		if len(h.buffer) == h.pieceLength {
+			h.hashBuffer()
+		}
+	}
+	return written, nil
+}
+
+// hashBuffer appends the hash of the buffered piece to the pieces.
+func (h *pieceHasher) hashBuffer() {
+	sum := sha1.Sum(h.buffer)
+	h.pieces = append(h.pieces, sum[:]...)
+	h.buffer = h.buffer[:0]
+}
+
+// Sum hashes the last, possibly shorter, piece and returns the concatenated piece hashes.
+func (h *pieceHasher) Sum() []byte {
+	if len(h.buffer) > 0 {
+		h.hashBuffer()
+	}
+	return h.pieces
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// writeTestFiles creates the files, by slash separated path, under a new temp dir and returns the dir.
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "release")
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		err = os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	return root
+}
+
+func TestCreateTorrentDirectory(t *testing.T) {
+	root := writeTestFiles(t, map[string]string{"b.txt": "bbb", "docs/a.txt": "aa"})
+	torrent, err := CreateTorrent(root, CreateOptions{PieceLength: 4, Announce: "http://tracker/announce"})
+	if err != nil {
+		t.Fatalf("CreateTorrent: %v", err)
+	}
+
+	// The torrent we create is one we accept
+	path := filepath.Join(t.TempDir(), "release.torrent")
+	err = WriteTorrentFile(path, torrent)
+	if err != nil {
+		t.Fatalf("WriteTorrentFile: %v", err)
+	}
+	info, err := ParseTorrentFile(path)
+	if err != nil {
+		t.Fatalf("ParseTorrentFile of a created torrent: %v", err)
+	}
+	if info.Name != "release" || info.Length != 5 || len(info.Pieces) != 2 || len(info.Files) != 2 {
+		t.Errorf("parsed %+v, want 2 files of 5 bytes in 2 pieces", info)
+	}
+	if got := strings.Join(info.Files[1].Path, "/"); got != "docs/a.txt" {
+		t.Errorf("second file path = %q, want docs/a.txt", got)
+	}
+}
+
+func TestCreateTorrentRejectsUnsafeNames(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("a backslash separates paths on Windows")
+	}
+	root := writeTestFiles(t, map[string]string{"ok.txt": "a", `dir/a\b.txt`: "b"})
+	_, err := CreateTorrent(root, CreateOptions{PieceLength: 4})
+	if err == nil || !strings.Contains(err.Error(), `name "a\\b.txt" can't be used in a torrent`) {
+		t.Errorf("CreateTorrent with a backslash in a name: error = %v", err)
+	}
+}
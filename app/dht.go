@@ -0,0 +1,670 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// Mainline DHT (BEP 5) constants.
+const (
+	// dhtAlpha is the number of nodes queried at the same time during a lookup.
+	dhtAlpha = 3
+	// dhtMaxLookupQueries bounds the number of queries of a single lookup.
+	dhtMaxLookupQueries = 128
+	// dhtTokenRotation is how often the secret of the announce tokens changes; The previous secret is still accepted.
+	dhtTokenRotation = 5 * time.Minute
+	// dhtPeerTTL is how long an announced peer is kept.
+	dhtPeerTTL = 30 * time.Minute
+	// dhtMaxStoredPeers bounds the peers kept per info hash.
+	dhtMaxStoredPeers = 1000
+	// dhtMaxInfoHashes bounds the info hashes we keep peers for.
+	dhtMaxInfoHashes = 1000
+	// dhtPeerExpiryInterval is how often the expired peers of all the info hashes are dropped.
+	dhtPeerExpiryInterval = time.Minute
+	// dhtMaxValues bounds the peers returned by get_peers, so the response fits in a datagram.
+	dhtMaxValues = 50
+)
+
+// KRPC error codes.
+const (
+	krpcGenericError  = 201
+	krpcProtocolError = 203
+	krpcMethodUnknown = 204
+)
+
+// dhtQueryTimeout is how long a query waits for the response.
+var dhtQueryTimeout = 2 * time.Second
+
+// DHTBootstrapNodes are well-known nodes to join the DHT through.
+var DHTBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// krpcMessage is a KRPC query, response or error.
+type krpcMessage struct {
+	T string     `bencode:"t"`
+	Y string     `bencode:"y"`
+	Q string     `bencode:"q,omitempty"`
+	A *krpcArgs  `bencode:"a,omitempty"`
+	R *krpcReply `bencode:"r,omitempty"`
+	E []any      `bencode:"e,omitempty"`
+}
+
+// krpcArgs are the arguments of all the queries.
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+}
+
+// krpcReply are the values of all the responses.
+type krpcReply struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+}
+
+// dhtState is the node state persisted between runs, so the node keeps its ID and rejoins the DHT quickly.
+type dhtState struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+// pendingQuery is a query waiting for its response.
+type pendingQuery struct {
+	addr  string
+	reply chan krpcMessage
+}
+
+// DHT is a node of the mainline DHT. It answers the queries of other nodes, and finds the peers of
+// torrents without a tracker; It is a PeerSource.
+type DHT struct {
+	conn      *net.UDPConn
+	id        nodeID
+	table     *routingTable
+	statePath string
+	// savedNodes are the nodes loaded from the state file, pinged by Bootstrap
+	savedNodes []dhtNode
+
+	mu              sync.Mutex
+	pending         map[string]pendingQuery
+	nextTransaction uint16
+	// peers are the announced peers in compact format, by info hash
+	peers          map[string]map[string]time.Time
+	peersExpired   time.Time
+	secret         []byte
+	previousSecret []byte
+	secretRotated  time.Time
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDHT starts a DHT node listening on the UDP port; Port 0 picks any free port.
+// The node ID and known nodes are loaded from statePath if it exists, and saved there on Close;
+// An empty statePath keeps nothing.
+func NewDHT(port int, statePath string) (*DHT, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for DHT: %v", err)
+	}
+
+	d := &DHT{
+		conn:      conn,
+		statePath: statePath,
+		pending:   make(map[string]pendingQuery),
+		peers:     make(map[string]map[string]time.Time),
+		secret:    randomBytes(20),
+		closed:    make(chan struct{}),
+	}
+	d.secretRotated = time.Now()
+
+	if !d.loadState() {
+		copy(d.id[:], randomBytes(20))
+	}
+	d.table = newRoutingTable(d.id)
+
+	go d.serve()
+	return d, nil
+}
+
+// loadState reads the node ID and known nodes from the state file, and reports whether it succeeded.
+func (d *DHT) loadState() bool {
+	if d.statePath == "" {
+		return false
+	}
+	data, err := os.ReadFile(d.statePath)
+	if err != nil {
+		return false
+	}
+
+	var state dhtState
+	err = bencode.Unmarshal(data, &state)
+	if err != nil || len(state.ID) != 20 {
+		log.Printf("Ignoring invalid DHT state file %s", d.statePath)
+		return false
+	}
+	copy(d.id[:], state.ID)
+	d.savedNodes = parseCompactNodes(state.Nodes)
+	return true
+}
+
+// Save writes the node ID and the known nodes to the state file.
+func (d *DHT) Save() error {
+	if d.statePath == "" {
+		return nil
+	}
+
+	data, err := bencode.Marshal(dhtState{
+		ID:    string(d.id[:]),
+		Nodes: encodeCompactNodes(d.table.Nodes()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode DHT state: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(d.statePath), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to write DHT state: %v", err)
+	}
+	tmpPath := d.statePath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write DHT state: %v", err)
+	}
+	err = os.Rename(tmpPath, d.statePath)
+	if err != nil {
+		return fmt.Errorf("failed to write DHT state: %v", err)
+	}
+	return nil
+}
+
+// Close saves the state and stops the node.
+func (d *DHT) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		err = d.Save()
+		close(d.closed)
+		d.conn.Close()
+	})
+	return err
+}
+
+// registeredDHT returns the DHT registered as a peer source, or nil; Peers learn its port from our handshake.
+func registeredDHT() *DHT {
+	peerSources.mu.Lock()
+	defer peerSources.mu.Unlock()
+	for _, source := range peerSources.sources {
+		if d, ok := source.(*DHT); ok {
+			return d
+		}
+	}
+	return nil
+}
+
+// sendDHTPort tells a peer which runs a DHT node the port of our DHT node, if we run one.
+func sendDHTPort(conn net.Conn, handshake PeerHandshake) error {
+	d := registeredDHT()
+	if d == nil || !handshake.DHT {
+		return nil
+	}
+	err := sendPeerMessage(conn, newPortMessage(d.Addr().Port))
+	if err != nil {
+		return fmt.Errorf("failed to send port message: %v", err)
+	}
+	return nil
+}
+
+// Addr returns the UDP address the node listens on.
+func (d *DHT) Addr() *net.UDPAddr {
+	return d.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Nodes returns the number of nodes in the routing table.
+func (d *DHT) Nodes() int {
+	return d.table.Len()
+}
+
+// Bootstrap joins the DHT through the given nodes and the nodes saved in the state file,
+// then looks up our own ID to fill the routing table with our neighbours.
+func (d *DHT) Bootstrap(addrs []string) error {
+	var wg sync.WaitGroup
+	ping := func(addr *net.UDPAddr) {
+		defer wg.Done()
+		d.query(addr, "ping", &krpcArgs{})
+	}
+
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			log.Printf("Failed to resolve DHT node %s: %v", addr, err)
+			continue
+		}
+		wg.Add(1)
+		go ping(udpAddr)
+	}
+	for _, node := range d.savedNodes {
+		wg.Add(1)
+		go ping(node.addr)
+	}
+	wg.Wait()
+
+	if d.table.Len() == 0 {
+		return fmt.Errorf("no DHT node responded")
+	}
+	d.lookup(d.id, false)
+	return nil
+}
+
+// FindPeers looks up the peers of the torrent in the DHT, and announces us on the port to the
+// closest nodes; A port of 0 skips the announce.
+func (d *DHT) FindPeers(infoHash []byte, port int) ([]string, error) {
+	if len(infoHash) != 20 {
+		return nil, fmt.Errorf("invalid info hash length: %d", len(infoHash))
+	}
+	if d.table.Len() == 0 {
+		return nil, fmt.Errorf("DHT has no nodes")
+	}
+
+	var target nodeID
+	copy(target[:], infoHash)
+	peers, closest := d.lookup(target, true)
+
+	if port > 0 {
+		var wg sync.WaitGroup
+		for _, c := range closest {
+			if c.token == "" {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.query(c.node.addr, "announce_peer", &krpcArgs{InfoHash: string(infoHash), Port: port, Token: c.token})
+			}()
+		}
+		wg.Wait()
+	}
+	return peers, nil
+}
+
+// lookupCandidate is a node found during a lookup.
+type lookupCandidate struct {
+	node      dhtNode
+	queried   bool
+	responded bool
+	// token is the token received from get_peers, needed to announce to the node
+	token string
+}
+
+// lookup queries the nodes closer and closer to the target until the closest ones are all queried.
+// With getPeers, it asks for the peers of the target info hash on the way. It returns the peers found,
+// and the closest nodes which responded.
+func (d *DHT) lookup(target nodeID, getPeers bool) ([]string, []*lookupCandidate) {
+	var mu sync.Mutex
+	candidates := make([]*lookupCandidate, 0)
+	seen := make(map[string]bool)
+	add := func(node dhtNode) {
+		key := node.addr.String()
+		if node.id == d.id || seen[key] {
+			return
+		}
+		seen[key] = true
+		candidates = append(candidates, &lookupCandidate{node: node})
+	}
+	for _, node := range d.table.Closest(target, dhtBucketSize) {
+		add(node)
+	}
+
+	peers := make([]string, 0)
+	seenPeers := make(map[string]bool)
+
+	for queries := 0; queries < dhtMaxLookupQueries; {
+		// Query the closest nodes not queried yet, ignoring the ones which failed
+		sort.Slice(candidates, func(i, j int) bool { return target.closer(candidates[i].node.id, candidates[j].node.id) })
+		batch := make([]*lookupCandidate, 0, dhtAlpha)
+		active := 0
+		for _, c := range candidates {
+			if c.queried && !c.responded {
+				continue
+			}
+			if active++; active > dhtBucketSize {
+				break
+			}
+			if !c.queried && len(batch) < dhtAlpha {
+				c.queried = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		queries += len(batch)
+
+		var wg sync.WaitGroup
+		for _, c := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var reply *krpcReply
+				var err error
+				if getPeers {
+					reply, err = d.query(c.node.addr, "get_peers", &krpcArgs{InfoHash: string(target[:])})
+				} else {
+					reply, err = d.query(c.node.addr, "find_node", &krpcArgs{Target: string(target[:])})
+				}
+				if err != nil {
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				c.responded = true
+				c.token = reply.Token
+				for _, node := range parseCompactNodes(reply.Nodes) {
+					add(node)
+				}
+				for _, value := range reply.Values {
+					for _, peer := range parseCompactPeers(value) {
+						if !seenPeers[peer] {
+							seenPeers[peer] = true
+							peers = append(peers, peer)
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	closest := make([]*lookupCandidate, 0, dhtBucketSize)
+	for _, c := range candidates {
+		if c.responded && len(closest) < dhtBucketSize {
+			closest = append(closest, c)
+		}
+	}
+	return peers, closest
+}
+
+// query sends a query to the node and waits for its response. Nodes which respond are added to
+// the routing table, and nodes which keep failing to respond are removed from it.
+func (d *DHT) query(addr *net.UDPAddr, method string, args *krpcArgs) (*krpcReply, error) {
+	args.ID = string(d.id[:])
+	reply := make(chan krpcMessage, 1)
+
+	d.mu.Lock()
+	d.nextTransaction++
+	transaction := string(binary.BigEndian.AppendUint16(nil, d.nextTransaction))
+	d.pending[transaction] = pendingQuery{addr: addr.String(), reply: reply}
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, transaction)
+		d.mu.Unlock()
+	}()
+
+	err := d.send(addr, krpcMessage{T: transaction, Y: "q", Q: method, A: args})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg := <-reply:
+		if msg.Y == "e" {
+			return nil, fmt.Errorf("DHT node %s returned error: %v", addr, msg.E)
+		}
+		if msg.R == nil || len(msg.R.ID) != 20 {
+			return nil, fmt.Errorf("invalid response from DHT node %s", addr)
+		}
+		var id nodeID
+		copy(id[:], msg.R.ID)
+		d.table.Insert(id, addr)
+		return msg.R, nil
+
+	case <-time.After(dhtQueryTimeout):
+		d.table.Failed(addr)
+		return nil, fmt.Errorf("DHT node %s timed out", addr)
+
+	case <-d.closed:
+		return nil, fmt.Errorf("DHT is closed")
+	}
+}
+
+func (d *DHT) send(addr *net.UDPAddr, msg krpcMessage) error {
+	data, err := bencode.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode KRPC message: %v", err)
+	}
+	_, err = d.conn.WriteToUDP(data, addr)
+	if err != nil {
+		return fmt.Errorf("failed to send to DHT node %s: %v", addr, err)
+	}
+	return nil
+}
+
+func (d *DHT) sendError(transaction string, addr *net.UDPAddr, code int, message string) {
+	d.send(addr, krpcMessage{T: transaction, Y: "e", E: []any{code, message}})
+}
+
+// serve reads the incoming messages until the node is closed.
+func (d *DHT) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		var msg krpcMessage
+		err = bencode.UnmarshalLenient(buf[:n], &msg)
+		if err != nil {
+			continue
+		}
+
+		switch msg.Y {
+		case "q":
+			d.handleQuery(msg, addr)
+		case "r", "e":
+			d.mu.Lock()
+			pending, ok := d.pending[msg.T]
+			d.mu.Unlock()
+			// A response must come from the node the query was sent to
+			if ok && pending.addr == addr.String() {
+				select {
+				case pending.reply <- msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// handleQuery answers a query of another node.
+func (d *DHT) handleQuery(msg krpcMessage, addr *net.UDPAddr) {
+	if msg.A == nil || len(msg.A.ID) != 20 {
+		d.sendError(msg.T, addr, krpcProtocolError, "invalid arguments")
+		return
+	}
+	var id nodeID
+	copy(id[:], msg.A.ID)
+	d.table.Insert(id, addr)
+
+	reply := &krpcReply{ID: string(d.id[:])}
+	switch msg.Q {
+	case "ping":
+
+	case "find_node":
+		if len(msg.A.Target) != 20 {
+			d.sendError(msg.T, addr, krpcProtocolError, "invalid target")
+			return
+		}
+		var target nodeID
+		copy(target[:], msg.A.Target)
+		reply.Nodes = encodeCompactNodes(d.table.Closest(target, dhtBucketSize))
+
+	case "get_peers":
+		if len(msg.A.InfoHash) != 20 {
+			d.sendError(msg.T, addr, krpcProtocolError, "invalid info hash")
+			return
+		}
+		reply.Token = d.token(addr.IP)
+		reply.Values = d.storedPeers(msg.A.InfoHash)
+		if len(reply.Values) == 0 {
+			var target nodeID
+			copy(target[:], msg.A.InfoHash)
+			reply.Nodes = encodeCompactNodes(d.table.Closest(target, dhtBucketSize))
+		}
+
+	case "announce_peer":
+		if len(msg.A.InfoHash) != 20 {
+			d.sendError(msg.T, addr, krpcProtocolError, "invalid info hash")
+			return
+		}
+		if !d.validToken(msg.A.Token, addr.IP) {
+			d.sendError(msg.T, addr, krpcProtocolError, "invalid token")
+			return
+		}
+		// With implied_port, the peer is behind a NAT and listens on the port it sent from
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if !d.storePeer(msg.A.InfoHash, addr.IP, port) {
+			d.sendError(msg.T, addr, krpcGenericError, "invalid peer")
+			return
+		}
+
+	default:
+		d.sendError(msg.T, addr, krpcMethodUnknown, "method unknown")
+		return
+	}
+
+	d.send(addr, krpcMessage{T: msg.T, Y: "r", R: reply})
+}
+
+// token returns the token a node at the IP must send back to announce.
+func (d *DHT) token(ip net.IP) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotateSecret()
+	return tokenFor(d.secret, ip)
+}
+
+// validToken reports whether the token was given to the IP with the current or the previous secret.
+func (d *DHT) validToken(token string, ip net.IP) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotateSecret()
+	if token == tokenFor(d.secret, ip) {
+		return true
+	}
+	return d.previousSecret != nil && token == tokenFor(d.previousSecret, ip)
+}
+
+// rotateSecret changes the token secret once it is dhtTokenRotation old; d.mu must be held.
+func (d *DHT) rotateSecret() {
+	if time.Since(d.secretRotated) < dhtTokenRotation {
+		return
+	}
+	d.previousSecret = d.secret
+	d.secret = randomBytes(20)
+	d.secretRotated = time.Now()
+}
+
+func tokenFor(secret []byte, ip net.IP) string {
+	sum := sha1.Sum(append(append([]byte(nil), secret...), ip.To16()...))
+	return string(sum[:8])
+}
+
+// storePeer records an announced peer, and reports whether it is valid.
+// Once the peers of dhtMaxInfoHashes info hashes are kept, the peers of new info hashes are dropped.
+func (d *DHT) storePeer(infoHash string, ip net.IP, port int) bool {
+	peer, ok := encodeCompactPeer(ip, port)
+	if !ok {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expirePeers()
+	peers, ok := d.peers[infoHash]
+	if !ok {
+		if len(d.peers) >= dhtMaxInfoHashes {
+			return true
+		}
+		peers = make(map[string]time.Time)
+		d.peers[infoHash] = peers
+	}
+	if _, known := peers[peer]; !known && len(peers) >= dhtMaxStoredPeers {
+		return true
+	}
+	peers[peer] = time.Now()
+	return true
+}
+
+// storedPeers returns the peers announced for the info hash in the last dhtPeerTTL, in compact format.
+func (d *DHT) storedPeers(infoHash string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expirePeers()
+
+	values := make([]string, 0)
+	for peer := range d.peers[infoHash] {
+		if len(values) >= dhtMaxValues {
+			break
+		}
+		values = append(values, peer)
+	}
+	return values
+}
+
+// expirePeers drops the peers announced more than dhtPeerTTL ago, and the info hashes left without peers,
+// at most once per dhtPeerExpiryInterval; d.mu must be held.
+func (d *DHT) expirePeers() {
+	if time.Since(d.peersExpired) < dhtPeerExpiryInterval {
+		return
+	}
+	d.peersExpired = time.Now()
+
+	for infoHash, peers := range d.peers {
+		for peer, announced := range peers {
+			if time.Since(announced) > dhtPeerTTL {
+				delete(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			delete(d.peers, infoHash)
+		}
+	}
+}
+
+// randomBytes returns n cryptographically random bytes.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatalf("failed to generate random bytes: %v", err)
+	}
+	return b
+}
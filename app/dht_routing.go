@@ -0,0 +1,207 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Routing table constants of the DHT.
+const (
+	// dhtBucketSize is the number of nodes per bucket, `K` in BEP 5.
+	dhtBucketSize = 8
+	// dhtNodeStaleAfter is how long a node may go unseen before a new node may replace it.
+	dhtNodeStaleAfter = 15 * time.Minute
+	// dhtMaxNodeFailures is the number of queries in a row a node may fail before it is removed;
+	// A single lost datagram doesn't make a node bad.
+	dhtMaxNodeFailures = 3
+	// compactNodeLength is the length of a node in compact format; 20 bytes ID, 4 bytes IP, 2 bytes port.
+	compactNodeLength = 26
+)
+
+// nodeID is the 160-bit ID of a DHT node, in the same space as info hashes.
+type nodeID [20]byte
+
+// distance returns the XOR distance between two IDs.
+func (id nodeID) distance(other nodeID) nodeID {
+	var d nodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to the target than b.
+func (target nodeID) closer(a, b nodeID) bool {
+	da, db := target.distance(a), target.distance(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// dhtNode is a node of the DHT known to the routing table.
+type dhtNode struct {
+	id       nodeID
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	// failures is the number of queries the node failed to answer since its last response
+	failures int
+}
+
+// routingTable keeps the known nodes in buckets by the length of the prefix they share with our ID.
+// Nodes sharing a longer prefix are closer, so the table knows more about the space near our ID.
+type routingTable struct {
+	mu      sync.Mutex
+	own     nodeID
+	buckets [160][]*dhtNode
+}
+
+func newRoutingTable(own nodeID) *routingTable {
+	return &routingTable{own: own}
+}
+
+// bucketIndex returns the bucket of the ID, which is the length of the prefix it shares with our ID, or -1 for our ID.
+func (t *routingTable) bucketIndex(id nodeID) int {
+	d := t.own.distance(id)
+	for i, b := range d {
+		for bit := 0; bit < 8; bit++ {
+			if b&(0x80>>bit) != 0 {
+				return i*8 + bit
+			}
+		}
+	}
+	return -1
+}
+
+// Insert adds a node which just responded, or marks it seen if it is known already.
+// If its bucket is full, the node replaces a stale or failing one, or is dropped.
+func (t *routingTable) Insert(id nodeID, addr *net.UDPAddr) {
+	index := t.bucketIndex(id)
+	if index < 0 || addr.IP.To4() == nil || addr.Port == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bucket := t.buckets[index]
+	for _, node := range bucket {
+		if node.id == id {
+			node.addr = addr
+			node.lastSeen = time.Now()
+			node.failures = 0
+			return
+		}
+	}
+
+	node := &dhtNode{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < dhtBucketSize {
+		t.buckets[index] = append(bucket, node)
+		return
+	}
+	for i, old := range bucket {
+		if old.failures > 0 || time.Since(old.lastSeen) > dhtNodeStaleAfter {
+			bucket[i] = node
+			return
+		}
+	}
+}
+
+// Failed records that the nodes at the address failed to respond, and removes them once they
+// failed dhtMaxNodeFailures queries in a row.
+func (t *routingTable) Failed(addr *net.UDPAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for index, bucket := range t.buckets {
+		kept := bucket[:0]
+		for _, node := range bucket {
+			if node.addr.String() == addr.String() {
+				node.failures++
+			}
+			if node.failures < dhtMaxNodeFailures {
+				kept = append(kept, node)
+			}
+		}
+		t.buckets[index] = kept
+	}
+}
+
+// Closest returns up to n known nodes closest to the target, closest first.
+func (t *routingTable) Closest(target nodeID, n int) []dhtNode {
+	nodes := t.Nodes()
+	sort.Slice(nodes, func(i, j int) bool { return target.closer(nodes[i].id, nodes[j].id) })
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// Nodes returns a copy of all the known nodes.
+func (t *routingTable) Nodes() []dhtNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	nodes := make([]dhtNode, 0)
+	for _, bucket := range t.buckets {
+		for _, node := range bucket {
+			nodes = append(nodes, *node)
+		}
+	}
+	return nodes
+}
+
+// Len returns the number of known nodes.
+func (t *routingTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// encodeCompactNodes encodes the IPv4 nodes in compact node format.
+func encodeCompactNodes(nodes []dhtNode) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeLength)
+	for _, node := range nodes {
+		ip := node.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, node.id[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(node.addr.Port))
+	}
+	return string(buf)
+}
+
+// parseCompactNodes parses nodes in compact node format; Nodes with port 0 are skipped.
+func parseCompactNodes(nodesStr string) []dhtNode {
+	nodes := make([]dhtNode, 0)
+	for i := 0; i+compactNodeLength <= len(nodesStr); i += compactNodeLength {
+		node := []byte(nodesStr[i : i+compactNodeLength])
+		port := int(binary.BigEndian.Uint16(node[24:]))
+		if port == 0 {
+			continue
+		}
+
+		var id nodeID
+		copy(id[:], node[:20])
+		ip := net.IPv4(node[20], node[21], node[22], node[23])
+		nodes = append(nodes, dhtNode{id: id, addr: &net.UDPAddr{IP: ip, Port: port}})
+	}
+	return nodes
+}
+
+// encodeCompactPeer encodes an IPv4 peer in the 6 bytes compact format read by parseCompactPeers.
+func encodeCompactPeer(ip net.IP, port int) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || port <= 0 || port > 65535 {
+		return "", false
+	}
+	return string(binary.BigEndian.AppendUint16(append([]byte(nil), ip4...), uint16(port))), true
+}
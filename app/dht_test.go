@@ -0,0 +1,241 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// newTestDHT starts a DHT node on a free port, without a state file.
+func newTestDHT(t *testing.T) *DHT {
+	t.Helper()
+	d, err := NewDHT(0, "")
+	if err != nil {
+		t.Fatalf("NewDHT: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// loopbackAddr returns the address of the DHT node on 127.0.0.1.
+func loopbackAddr(d *DHT) string {
+	return fmt.Sprintf("127.0.0.1:%d", d.Addr().Port)
+}
+
+// newTestDHTNetwork starts n DHT nodes which all join the DHT through the first one.
+func newTestDHTNetwork(t *testing.T, n int) []*DHT {
+	t.Helper()
+	old := dhtQueryTimeout
+	dhtQueryTimeout = 500 * time.Millisecond
+	t.Cleanup(func() { dhtQueryTimeout = old })
+
+	nodes := []*DHT{newTestDHT(t)}
+	for i := 1; i < n; i++ {
+		d := newTestDHT(t)
+		err := d.Bootstrap([]string{loopbackAddr(nodes[0])})
+		if err != nil {
+			t.Fatalf("Bootstrap of node %d: %v", i, err)
+		}
+		nodes = append(nodes, d)
+	}
+	return nodes
+}
+
+func TestDHTBootstrap(t *testing.T) {
+	nodes := newTestDHTNetwork(t, 4)
+
+	// The first node learned about every node which bootstrapped through it
+	if got := nodes[0].Nodes(); got != 3 {
+		t.Errorf("bootstrap node knows %d nodes, want 3", got)
+	}
+	// The last node found the others through the lookup of its own ID
+	if got := nodes[3].Nodes(); got != 3 {
+		t.Errorf("last node knows %d nodes, want 3", got)
+	}
+
+	d := newTestDHT(t)
+	err := d.Bootstrap(nil)
+	if err == nil {
+		t.Errorf("Bootstrap without nodes succeeded")
+	}
+}
+
+func TestDHTAnnounceAndGetPeers(t *testing.T) {
+	nodes := newTestDHTNetwork(t, 4)
+	infoHash := []byte(strings.Repeat("h", 20))
+
+	peers, err := nodes[1].FindPeers(infoHash, 51413)
+	if err != nil {
+		t.Fatalf("FindPeers with announce: %v", err)
+	}
+	if len(peers) != 0 {
+		t.Errorf("found peers %v before any announce", peers)
+	}
+
+	// Without a port, the lookup doesn't announce
+	peers, err = nodes[2].FindPeers(infoHash, 0)
+	if err != nil {
+		t.Fatalf("FindPeers: %v", err)
+	}
+	want := []string{"127.0.0.1:51413"}
+	if fmt.Sprint(peers) != fmt.Sprint(want) {
+		t.Errorf("peers = %v, want %v", peers, want)
+	}
+	peers, err = nodes[3].FindPeers(infoHash, 0)
+	if err != nil {
+		t.Fatalf("FindPeers: %v", err)
+	}
+	if fmt.Sprint(peers) != fmt.Sprint(want) {
+		t.Errorf("peers after a lookup without announce = %v, want %v", peers, want)
+	}
+}
+
+// sendKRPC sends a query from conn to the DHT node and returns the response.
+func sendKRPC(t *testing.T, conn *net.UDPConn, d *DHT, msg krpcMessage) krpcMessage {
+	t.Helper()
+	data, err := bencode.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	addr, err := net.ResolveUDPAddr("udp4", loopbackAddr(d))
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr: %v", err)
+	}
+	_, err = conn.WriteToUDP(data, addr)
+	if err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 65536)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no response to %s: %v", msg.Q, err)
+	}
+	var resp krpcMessage
+	err = bencode.UnmarshalLenient(buf[:n], &resp)
+	if err != nil {
+		t.Fatalf("invalid response to %s: %v", msg.Q, err)
+	}
+	return resp
+}
+
+func TestDHTAnnounceToken(t *testing.T) {
+	d := newTestDHT(t)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer conn.Close()
+
+	id := strings.Repeat("n", 20)
+	infoHash := strings.Repeat("h", 20)
+	announce := func(token string) krpcMessage {
+		return sendKRPC(t, conn, d, krpcMessage{T: "aa", Y: "q", Q: "announce_peer",
+			A: &krpcArgs{ID: id, InfoHash: infoHash, Port: 6881, Token: token}})
+	}
+
+	resp := announce("")
+	if resp.Y != "e" || fmt.Sprint(resp.E) != fmt.Sprint([]any{krpcProtocolError, "invalid token"}) {
+		t.Errorf("announce without token: got %+v, want an invalid token error", resp)
+	}
+	resp = announce("forged")
+	if resp.Y != "e" {
+		t.Errorf("announce with a forged token: got %+v, want an error", resp)
+	}
+
+	resp = sendKRPC(t, conn, d, krpcMessage{T: "gp", Y: "q", Q: "get_peers", A: &krpcArgs{ID: id, InfoHash: infoHash}})
+	if resp.Y != "r" || resp.R == nil || resp.R.Token == "" {
+		t.Fatalf("get_peers: got %+v, want a token", resp)
+	}
+	token := resp.R.Token
+
+	// A token is only valid for the IP it was given to
+	if d.validToken(token, net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("token of 127.0.0.1 accepted for 10.0.0.1")
+	}
+
+	resp = announce(token)
+	if resp.Y != "r" {
+		t.Fatalf("announce with the token of get_peers: got %+v", resp)
+	}
+	if got := d.storedPeers(infoHash); len(got) != 1 || got[0] != "\x7f\x00\x00\x01\x1a\xe1" {
+		t.Errorf("stored peers = %q, want 127.0.0.1:6881", got)
+	}
+
+	// The token of the previous secret is still accepted after a rotation, but not after two
+	d.mu.Lock()
+	d.secretRotated = time.Now().Add(-dhtTokenRotation)
+	d.mu.Unlock()
+	if !d.validToken(token, net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("token rejected after one rotation")
+	}
+	d.mu.Lock()
+	d.secretRotated = time.Now().Add(-dhtTokenRotation)
+	d.mu.Unlock()
+	if d.validToken(token, net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("token accepted after two rotations")
+	}
+}
+
+func TestRoutingTableFailures(t *testing.T) {
+	var own, id nodeID
+	id[0] = 0x80
+	table := newRoutingTable(own)
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	table.Insert(id, addr)
+
+	for i := 1; i < dhtMaxNodeFailures; i++ {
+		table.Failed(addr)
+		if table.Len() != 1 {
+			t.Fatalf("node removed after %d failures", i)
+		}
+	}
+
+	// A response resets the failures
+	table.Insert(id, addr)
+	table.Failed(addr)
+	if table.Len() != 1 {
+		t.Fatalf("node removed after a response and a failure")
+	}
+
+	for i := 1; i < dhtMaxNodeFailures; i++ {
+		table.Failed(addr)
+	}
+	if table.Len() != 0 {
+		t.Errorf("node kept after %d failures in a row", dhtMaxNodeFailures)
+	}
+}
+
+func TestDHTStoredInfoHashesLimit(t *testing.T) {
+	d := newTestDHT(t)
+	for i := 0; i < dhtMaxInfoHashes+10; i++ {
+		d.storePeer(fmt.Sprintf("%020d", i), net.IPv4(10, 0, 0, 1), 6881)
+	}
+	d.mu.Lock()
+	stored := len(d.peers)
+	d.mu.Unlock()
+	if stored != dhtMaxInfoHashes {
+		t.Errorf("kept peers of %d info hashes, want %d", stored, dhtMaxInfoHashes)
+	}
+
+	// Once the peers expire, there is room for new info hashes
+	d.mu.Lock()
+	for _, peers := range d.peers {
+		for peer := range peers {
+			peers[peer] = time.Now().Add(-2 * dhtPeerTTL)
+		}
+	}
+	d.peersExpired = time.Time{}
+	d.mu.Unlock()
+
+	infoHash := strings.Repeat("x", 20)
+	d.storePeer(infoHash, net.IPv4(10, 0, 0, 1), 6881)
+	if got := d.storedPeers(infoHash); len(got) != 1 {
+		t.Errorf("stored peers of a new info hash after expiry = %q, want one", got)
+	}
+}
@@ -0,0 +1,220 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// handshakeProtocol is the protocol string of the BitTorrent handshake.
+	handshakeProtocol = "BitTorrent protocol"
+	// handshakeLength is the length of a handshake; Protocol string length, protocol string, reserved bytes, info hash and peer ID.
+	handshakeLength = 1 + len(handshakeProtocol) + 8 + 20 + 20
+	// handshakeTimeout is how long a peer has to send its handshake.
+	handshakeTimeout = 30 * time.Second
+)
+
+// PeerHandshake is the validated handshake of a peer, with the capabilities it announced in the reserved bytes.
+type PeerHandshake struct {
+	InfoHash []byte
+	PeerID   []byte
+	Reserved [8]byte
+
+	// Extensions is set if the peer supports the extension protocol (BEP 10)
+	Extensions bool
+	// DHT is set if the peer runs a DHT node (BEP 5)
+	DHT bool
+	// Fast is set if the peer supports the Fast Extension (BEP 6)
+	Fast bool
+
+	// Client is the name and version of the client parsed from the peer ID, or empty if unknown
+	Client string
+}
+
+// HandshakePeer performs the BitTorrent handshake and returns the handshake of the peer, after checking
+// it is for the same torrent. It sends nothing else; The session chooses what to send next.
+func HandshakePeer(conn net.Conn, infoHash []byte) (PeerHandshake, error) {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return PeerHandshake{}, err
+	}
+
+	_, err = conn.Write(newHandshakeMessage(reservedBytes(true), infoHash, GenerateRandomID(20)))
+	if err != nil {
+		return PeerHandshake{}, fmt.Errorf("failed to send handshake message: %v", err)
+	}
+
+	handshake, err := readHandshake(conn)
+	if err != nil {
+		return PeerHandshake{}, err
+	}
+	if !bytes.Equal(handshake.InfoHash, infoHash) {
+		return PeerHandshake{}, fmt.Errorf("peer answered for info hash %x instead of %x", handshake.InfoHash, infoHash)
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return PeerHandshake{}, err
+	}
+	return handshake, nil
+}
+
+// reservedBytes returns the reserved bytes of our handshake, with the bits of the Fast Extension (BEP 6),
+// of the extension protocol (BEP 10) if extensions is set, and of the DHT (BEP 5) if we run a DHT node.
+func reservedBytes(extensions bool) []byte {
+	reserved := []byte{0, 0, 0, 0, 0, 0, 0, 0x04}
+	if extensions {
+		reserved[5] |= 0x10
+	}
+	if registeredDHT() != nil {
+		reserved[7] |= 0x01
+	}
+	return reserved
+}
+
+// newHandshakeMessage returns our handshake with the given reserved bytes.
+func newHandshakeMessage(reserved, infoHash []byte, peerID string) []byte {
+	var msg bytes.Buffer
+	msg.WriteByte(byte(len(handshakeProtocol)))
+	msg.WriteString(handshakeProtocol)
+	msg.Write(reserved)
+	msg.Write(infoHash)
+	msg.WriteString(peerID)
+	return msg.Bytes()
+}
+
+// readHandshake reads the handshake of a peer and checks its protocol string.
+func readHandshake(conn net.Conn) (PeerHandshake, error) {
+	resp, err := readExactBytes(conn, handshakeLength)
+	if err != nil {
+		return PeerHandshake{}, fmt.Errorf("failed to read handshake: %v", err)
+	}
+	return parseHandshake(resp)
+}
+
+// parseHandshake decodes a handshake and its reserved bytes.
+func parseHandshake(data []byte) (PeerHandshake, error) {
+	if len(data) != handshakeLength {
+		return PeerHandshake{}, fmt.Errorf("invalid handshake length: %d", len(data))
+	}
+	if int(data[0]) != len(handshakeProtocol) || string(data[1:20]) != handshakeProtocol {
+		return PeerHandshake{}, fmt.Errorf("invalid handshake protocol: %q", data[1:min(len(data), 1+int(data[0]))])
+	}
+
+	h := PeerHandshake{
+		InfoHash: append([]byte(nil), data[28:48]...),
+		PeerID:   append([]byte(nil), data[48:68]...),
+	}
+	copy(h.Reserved[:], data[20:28])
+	h.Extensions = h.Reserved[5]&0x10 != 0
+	h.DHT = h.Reserved[7]&0x01 != 0
+	h.Fast = h.Reserved[7]&0x04 != 0
+	h.Client = parseClientName(h.PeerID)
+	return h, nil
+}
+
+// azureusClients are the client codes of Azureus-style peer IDs, like `-qB4650-`.
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WD": "WebTorrent Desktop",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients are the client codes of Shadow-style peer IDs, like `T03I-----`.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowVersionDigits are the digits of Shadow-style versions; Each character is a number from 0 to 63.
+const shadowVersionDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// parseClientName returns the client name and version of an Azureus-style or Shadow-style peer ID.
+// Other peer IDs, like the `M7-2-2--` of Mainline, fall back to their printable prefix, or an empty string.
+func parseClientName(peerID []byte) string {
+	if len(peerID) < 9 {
+		return printablePrefix(peerID)
+	}
+
+	// Azureus-style: '-', two characters of client code, four of version, '-'
+	if peerID[0] == '-' && peerID[7] == '-' && isAlphanumeric(peerID[1:7]) {
+		code := string(peerID[1:3])
+		name, ok := azureusClients[code]
+		if !ok {
+			name = code
+		}
+		version := make([]string, 0, 4)
+		for _, c := range peerID[3:7] {
+			version = append(version, string(c))
+		}
+		return name + " " + strings.Join(version, ".")
+	}
+
+	name, ok := parseShadowClientName(peerID)
+	if !ok {
+		return printablePrefix(peerID)
+	}
+	return name
+}
+
+// parseShadowClientName returns the client name and version of a Shadow-style peer ID: client code,
+// up to five characters of version, then '-' padding.
+func parseShadowClientName(peerID []byte) (string, bool) {
+	name, ok := shadowClients[peerID[0]]
+	if !ok {
+		return "", false
+	}
+	end := bytes.IndexByte(peerID[1:7], '-')
+	if end <= 0 {
+		return "", false
+	}
+	version := make([]string, 0, end)
+	for _, c := range peerID[1 : 1+end] {
+		digit := strings.IndexByte(shadowVersionDigits, c)
+		if digit < 0 {
+			return "", false
+		}
+		version = append(version, fmt.Sprint(digit))
+	}
+	return name + " " + strings.Join(version, "."), true
+}
+
+// printablePrefix returns the printable ASCII characters at the start of the peer ID, without the '-' padding.
+func printablePrefix(peerID []byte) string {
+	end := 0
+	for end < len(peerID) && peerID[end] > ' ' && peerID[end] <= '~' {
+		end++
+	}
+	return strings.TrimRight(string(peerID[:end]), "-")
+}
+
+func isAlphanumeric(b []byte) bool {
+	for _, c := range b {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,330 @@
+package app
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local Service Discovery (BEP 14) constants.
+const (
+	lsdGroup = "239.192.152.143:6771"
+	// lsdAnnounceInterval is how often the announced torrents are announced again.
+	lsdAnnounceInterval = 5 * time.Minute
+	// lsdMinInterval is the minimum time between two announces of the same torrent.
+	lsdMinInterval = time.Minute
+	// lsdMinAnswerInterval is the minimum time between two answers to the lookups of the same torrent.
+	lsdMinAnswerInterval = time.Second
+	// lsdPeerTTL is how long a peer stays known after its last announce; Peers announce every lsdAnnounceInterval.
+	lsdPeerTTL = 2 * lsdAnnounceInterval
+)
+
+// lsdFindTimeout is how long FindPeers waits for a local peer to answer when none is known yet.
+var lsdFindTimeout = 3 * time.Second
+
+// lsdTorrent is a torrent we announce on the local network.
+type lsdTorrent struct {
+	port          int
+	lastAnnounced time.Time
+	lastAnswered  time.Time
+}
+
+// LSD announces torrents to the local network with multicast, and finds the local peers announcing the
+// same torrents; It is a PeerSource. Peers announcing while a download runs are added to the download.
+type LSD struct {
+	conn *net.UDPConn
+	// sendConn sends the announces; The multicast conn doesn't loop them back to other peers on this host
+	sendConn *net.UDPConn
+	group    *net.UDPAddr
+	// cookie marks our announces, so we ignore them when they loop back to us
+	cookie string
+
+	mu       sync.Mutex
+	torrents map[string]*lsdTorrent
+	// peers are the local peers by info hash, with the time of their last announce
+	peers map[string]map[string]time.Time
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLSD joins the LSD multicast group and starts listening for announces.
+func NewLSD() (*LSD, error) {
+	group, err := net.ResolveUDPAddr("udp4", lsdGroup)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join LSD multicast group: %v", err)
+	}
+	sendConn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open LSD socket: %v", err)
+	}
+
+	l := &LSD{
+		conn:     conn,
+		sendConn: sendConn,
+		group:    group,
+		cookie:   GenerateRandomID(8),
+		torrents: make(map[string]*lsdTorrent),
+		peers:    make(map[string]map[string]time.Time),
+		closed:   make(chan struct{}),
+	}
+	go l.serve()
+	go l.announceLoop()
+	return l, nil
+}
+
+// Close stops announcing and listening.
+func (l *LSD) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.conn.Close()
+		l.sendConn.Close()
+	})
+	return nil
+}
+
+// Announce tells the local network that we serve the torrent on the port, now unless it was announced
+// in the last minute, and then every lsdAnnounceInterval until the LSD is closed.
+func (l *LSD) Announce(infoHash []byte, port int) error {
+	l.mu.Lock()
+	torrent, ok := l.torrents[string(infoHash)]
+	if !ok {
+		torrent = &lsdTorrent{}
+		l.torrents[string(infoHash)] = torrent
+	}
+	torrent.port = port
+	due := time.Since(torrent.lastAnnounced) >= lsdMinInterval
+	if due {
+		torrent.lastAnnounced = time.Now()
+	}
+	l.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+	return l.send(infoHash, port)
+}
+
+// FindPeers announces the torrent, and returns the local peers of the torrent. If none is known yet,
+// it waits up to lsdFindTimeout for one to answer; With a port of 0, it only asks the local peers of
+// the torrent to announce themselves.
+func (l *LSD) FindPeers(infoHash []byte, port int) ([]string, error) {
+	return l.findPeersUntil(infoHash, port, nil)
+}
+
+// findPeersUntil is FindPeers, but stops waiting for a local peer once found is closed.
+func (l *LSD) findPeersUntil(infoHash []byte, port int, found <-chan struct{}) ([]string, error) {
+	answered := make(chan struct{}, 1)
+	stop := watchPeers(infoHash, func([]string) {
+		select {
+		case answered <- struct{}{}:
+		default:
+		}
+	})
+	defer stop()
+
+	if port > 0 {
+		err := l.Announce(infoHash, port)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(l.knownPeers(infoHash)) == 0 {
+		if port == 0 {
+			err := l.send(infoHash, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		select {
+		case <-answered:
+		case <-found:
+		case <-time.After(lsdFindTimeout):
+		case <-l.closed:
+		}
+	}
+	return l.knownPeers(infoHash), nil
+}
+
+// knownPeers returns the peers which announced the torrent in the last lsdPeerTTL.
+func (l *LSD) knownPeers(infoHash []byte) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	peers := make([]string, 0)
+	for peer, announced := range l.peers[string(infoHash)] {
+		if time.Since(announced) > lsdPeerTTL {
+			delete(l.peers[string(infoHash)], peer)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// send multicasts an announce of the torrent; Port 0 announces a lookup, which peers of the torrent answer.
+func (l *LSD) send(infoHash []byte, port int) error {
+	msg := "BT-SEARCH * HTTP/1.1\r\n" +
+		"Host: " + lsdGroup + "\r\n" +
+		"Port: " + strconv.Itoa(port) + "\r\n" +
+		"Infohash: " + hex.EncodeToString(infoHash) + "\r\n" +
+		"cookie: " + l.cookie + "\r\n" +
+		"\r\n\r\n"
+
+	_, err := l.sendConn.WriteToUDP([]byte(msg), l.group)
+	if err != nil {
+		return fmt.Errorf("failed to send LSD announce: %v", err)
+	}
+	return nil
+}
+
+// announceLoop announces the torrents again every lsdAnnounceInterval.
+func (l *LSD) announceLoop() {
+	ticker := time.NewTicker(lsdAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		due := make(map[string]int)
+		for infoHash, torrent := range l.torrents {
+			due[infoHash] = torrent.port
+			torrent.lastAnnounced = time.Now()
+		}
+		l.mu.Unlock()
+
+		for infoHash, port := range due {
+			err := l.send([]byte(infoHash), port)
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+}
+
+// serve reads the announces of the local peers until the LSD is closed.
+func (l *LSD) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		announce, err := parseLSDAnnounce(buf[:n])
+		if err != nil || announce.cookie == l.cookie {
+			continue
+		}
+
+		if announce.port == 0 {
+			for _, infoHash := range announce.infoHashes {
+				l.answer(infoHash)
+			}
+			continue
+		}
+		peer := net.JoinHostPort(addr.IP.String(), strconv.Itoa(announce.port))
+		for _, infoHash := range announce.infoHashes {
+			l.addPeer(infoHash, peer)
+		}
+	}
+}
+
+// addPeer records a local peer of the torrent and passes it to the running downloads.
+// If the peer is new, we answer so it finds us without waiting for our next announce.
+func (l *LSD) addPeer(infoHash []byte, peer string) {
+	l.mu.Lock()
+	peers, ok := l.peers[string(infoHash)]
+	if !ok {
+		peers = make(map[string]time.Time)
+		l.peers[string(infoHash)] = peers
+	}
+	_, known := peers[peer]
+	peers[peer] = time.Now()
+	l.mu.Unlock()
+
+	discoveredPeers(infoHash, []string{peer})
+
+	if !known {
+		l.answer(infoHash)
+	}
+}
+
+// answer announces the torrent right away if we announce it, at most once every lsdMinAnswerInterval.
+func (l *LSD) answer(infoHash []byte) {
+	l.mu.Lock()
+	torrent, announced := l.torrents[string(infoHash)]
+	due := announced && time.Since(torrent.lastAnswered) >= lsdMinAnswerInterval
+	port := 0
+	if due {
+		torrent.lastAnswered = time.Now()
+		port = torrent.port
+	}
+	l.mu.Unlock()
+
+	if !due {
+		return
+	}
+	err := l.send(infoHash, port)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// lsdAnnounce is a parsed LSD announce.
+type lsdAnnounce struct {
+	port       int
+	infoHashes [][]byte
+	cookie     string
+}
+
+// parseLSDAnnounce parses a BT-SEARCH message; It may announce several info hashes, and port 0 is a lookup.
+func parseLSDAnnounce(data []byte) (lsdAnnounce, error) {
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(string(data))))
+	line, err := reader.ReadLine()
+	if err != nil || line != "BT-SEARCH * HTTP/1.1" {
+		return lsdAnnounce{}, fmt.Errorf("not an LSD announce")
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return lsdAnnounce{}, fmt.Errorf("invalid LSD announce: %v", err)
+	}
+
+	var announce lsdAnnounce
+	announce.port, err = strconv.Atoi(header.Get("Port"))
+	if err != nil || announce.port < 0 || announce.port > 65535 {
+		return lsdAnnounce{}, fmt.Errorf("invalid LSD announce port: %q", header.Get("Port"))
+	}
+	for _, value := range header.Values("Infohash") {
+		infoHash, err := hex.DecodeString(strings.TrimSpace(value))
+		if err == nil && len(infoHash) == 20 {
+			announce.infoHashes = append(announce.infoHashes, infoHash)
+		}
+	}
+	if len(announce.infoHashes) == 0 {
+		return lsdAnnounce{}, fmt.Errorf("LSD announce has no info hash")
+	}
+	announce.cookie = header.Get("Cookie")
+	return announce, nil
+}
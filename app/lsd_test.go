@@ -0,0 +1,61 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLSD joins the LSD multicast group, or skips the test if multicast isn't available.
+func newTestLSD(t *testing.T) *LSD {
+	t.Helper()
+	l, err := NewLSD()
+	if err != nil {
+		t.Skipf("NewLSD: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestLSDLookupFindsEarlierSeeder(t *testing.T) {
+	infoHash := []byte(strings.Repeat("l", 20))
+
+	seeder := newTestLSD(t)
+	err := seeder.Announce(infoHash, 51413)
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The downloader joins after the announce, so only the answer to its lookup tells it about the seeder
+	downloader := newTestLSD(t)
+	peers, err := downloader.FindPeers(infoHash, 0)
+	if err != nil {
+		t.Fatalf("FindPeers: %v", err)
+	}
+	if len(peers) != 1 || !strings.HasSuffix(peers[0], ":51413") {
+		t.Errorf("peers = %v, want the seeder on port 51413", peers)
+	}
+
+	// A lookup doesn't make the downloader a peer
+	if got := seeder.knownPeers(infoHash); len(got) != 0 {
+		t.Errorf("seeder knows peers %v after a lookup", got)
+	}
+}
+
+func TestParseLSDAnnounce(t *testing.T) {
+	infoHash := strings.Repeat("ab", 20)
+	announce, err := parseLSDAnnounce([]byte("BT-SEARCH * HTTP/1.1\r\nHost: " + lsdGroup + "\r\nPort: 0\r\n" +
+		"Infohash: " + infoHash + "\r\ncookie: c\r\n\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("parseLSDAnnounce of a lookup: %v", err)
+	}
+	if announce.port != 0 || len(announce.infoHashes) != 1 || announce.cookie != "c" {
+		t.Errorf("lookup parsed as %+v", announce)
+	}
+
+	_, err = parseLSDAnnounce([]byte("BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: " + infoHash + "\r\n\r\n"))
+	if err == nil {
+		t.Errorf("parseLSDAnnounce accepted port 70000")
+	}
+}
@@ -1,21 +1,18 @@
 package app
 
 import (
-	"bytes"
 	"encoding/hex"
-	"fmt"
-	"io"
-	"net"
-	"net/http"
 	"net/url"
 	"strings"
 )
 
 // MagnetMetaInfo represents metadata for a magnet link.
 type MagnetMetaInfo struct {
-	TrackerUrl string
-	InfoHash   []byte
-	FileName   string
+	// TrackerUrl is the first tracker of the link; TrackerUrls holds all of them
+	TrackerUrl  string
+	TrackerUrls []string
+	InfoHash    []byte
+	FileName    string
 }
 
 // ParseMagnetLink parses a magnet link to a MagnetMetaInfo object.
@@ -40,7 +37,10 @@ func ParseMagnetLink(magnetLink string) (MagnetMetaInfo, error) {
 			if err != nil {
 				return MagnetMetaInfo{}, err
 			}
-			result.TrackerUrl = url
+			if result.TrackerUrl == "" {
+				result.TrackerUrl = url
+			}
+			result.TrackerUrls = append(result.TrackerUrls, url)
 		} else if strings.HasPrefix(part, "dn=") {
 			result.FileName = strings.TrimPrefix(part, "dn=")
 		}
@@ -49,72 +49,22 @@ func ParseMagnetLink(magnetLink string) (MagnetMetaInfo, error) {
 	return result, nil
 }
 
-// GetMagnetPeers returns list of all available peers asking from the tracker.
+// GetMagnetPeers returns list of all available peers asking from the trackers of the magnet link and the peer sources.
 func GetMagnetPeers(info MagnetMetaInfo) ([]string, error) {
-	params := url.Values{}
-	params.Add("info_hash", string(info.InfoHash))
-	params.Add("peer_id", GenerateRandomID(20))
-	params.Add("port", "6881")
-	params.Add("uploaded", "0")
-	params.Add("downloaded", "0")
-	params.Add("left", "1")
-	params.Add("compact", "1")
-
-	fullUrl := info.TrackerUrl + "?" + params.Encode()
-
-	resp, err := http.Get(fullUrl)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
-	}
-
-	decoded, err := DecodeBencode(string(body))
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode response body: %v", err)
-	}
-
-	// Parse peers URL with ports; Each peer is 6 bytes, 4 bytes URL 2 bytes port
-	peersStr := decoded.Dict["peers"].Str
-	peers := make([]string, 0)
-	for i := 0; i < len(peersStr); i += 6 {
-		peer := peersStr[i : i+6]
-		peerUrl := fmt.Sprintf("%d.%d.%d.%d", peer[0], peer[1], peer[2], peer[3])
-		peerPort := int(peer[4])*256 + int(peer[5])
-		peers = append(peers, fmt.Sprintf("%s:%d", peerUrl, peerPort))
-	}
-
-	return peers, nil
+	// The length is unknown before fetching the metadata, but trackers expect a non-zero `left`
+	return findPeers(info.TrackerTiers(), AnnounceRequest{
+		InfoHash: info.InfoHash,
+		PeerID:   GenerateRandomID(20),
+		Port:     DefaultPort,
+		Left:     1,
+	})
 }
 
-// HandshakeMagnetPeer performs the BitTorrent handshake and returns the peer ID.
-func HandshakeMagnetPeer(conn net.Conn, info MagnetMetaInfo) ([]byte, error) {
-	var msg bytes.Buffer
-	msg.WriteByte(19)
-	msg.WriteString("BitTorrent protocol")
-	msg.Write([]byte{0, 0, 0, 0, 0, 0x10, 0, 0})
-	msg.Write(info.InfoHash)
-	msg.WriteString(GenerateRandomID(20))
-
-	_, err := conn.Write(msg.Bytes())
-	if err != nil {
-		return nil, fmt.Errorf("failed to send handshake message: %v", err)
-	}
-
-	resp, err := readExactBytes(conn, 68)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read handshake response: %v", err)
-	}
-
-	if resp[0] != 19 {
-		return nil, fmt.Errorf("invalid handshake response")
+// TrackerTiers returns each tracker of the magnet link as its own tier, in the order they appear in the link.
+func (info MagnetMetaInfo) TrackerTiers() [][]string {
+	tiers := make([][]string, 0, len(info.TrackerUrls))
+	for _, trackerUrl := range info.TrackerUrls {
+		tiers = append(tiers, []string{trackerUrl})
 	}
-	peerID := resp[48:]
-
-	return peerID, nil
+	return tiers
 }
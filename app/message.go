@@ -0,0 +1,186 @@
+package app
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MessageID identifies the type of a peer message.
+type MessageID int
+
+// Peer wire message IDs (BEP 3), plus the Fast Extension (BEP 6) and extension (BEP 10) messages.
+const (
+	// MsgKeepAlive is never sent on the wire; It marks messages of length 0.
+	MsgKeepAlive     MessageID = -1
+	MsgChoke         MessageID = 0
+	MsgUnchoke       MessageID = 1
+	MsgInterested    MessageID = 2
+	MsgNotInterested MessageID = 3
+	MsgHave          MessageID = 4
+	MsgBitfield      MessageID = 5
+	MsgRequest       MessageID = 6
+	MsgPiece         MessageID = 7
+	MsgCancel        MessageID = 8
+	MsgPort          MessageID = 9
+	MsgSuggestPiece  MessageID = 13
+	MsgHaveAll       MessageID = 14
+	MsgHaveNone      MessageID = 15
+	MsgRejectRequest MessageID = 16
+	MsgAllowedFast   MessageID = 17
+	MsgExtended      MessageID = 20
+)
+
+func (id MessageID) String() string {
+	switch id {
+	case MsgKeepAlive:
+		return "keep-alive"
+	case MsgChoke:
+		return "choke"
+	case MsgUnchoke:
+		return "unchoke"
+	case MsgInterested:
+		return "interested"
+	case MsgNotInterested:
+		return "not interested"
+	case MsgHave:
+		return "have"
+	case MsgBitfield:
+		return "bitfield"
+	case MsgRequest:
+		return "request"
+	case MsgPiece:
+		return "piece"
+	case MsgCancel:
+		return "cancel"
+	case MsgPort:
+		return "port"
+	case MsgSuggestPiece:
+		return "suggest piece"
+	case MsgHaveAll:
+		return "have all"
+	case MsgHaveNone:
+		return "have none"
+	case MsgRejectRequest:
+		return "reject request"
+	case MsgAllowedFast:
+		return "allowed fast"
+	case MsgExtended:
+		return "extended"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(id))
+	}
+}
+
+// newMessage returns a PeerMessage with the length computed from the payload.
+func newMessage(id MessageID, payload []byte) PeerMessage {
+	return PeerMessage{Length: 1 + len(payload), ID: id, Payload: payload}
+}
+
+// blockRequest is a block of a piece, as sent in request and cancel messages.
+type blockRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// newBlockMessage returns a request, cancel or reject request message for the block.
+func newBlockMessage(id MessageID, req blockRequest) PeerMessage {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(req.Index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(req.Begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(req.Length))
+	return newMessage(id, payload)
+}
+
+// parseBlockMessage parses the payload of a request, cancel or reject request message.
+func parseBlockMessage(msg PeerMessage) (blockRequest, error) {
+	if len(msg.Payload) != 12 {
+		return blockRequest{}, fmt.Errorf("invalid %s payload length: %d", msg.ID, len(msg.Payload))
+	}
+
+	return blockRequest{
+		Index:  int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+		Begin:  int(binary.BigEndian.Uint32(msg.Payload[4:8])),
+		Length: int(binary.BigEndian.Uint32(msg.Payload[8:12])),
+	}, nil
+}
+
+// newIndexMessage returns a have, suggest piece or allowed fast message for the piece.
+func newIndexMessage(id MessageID, index int) PeerMessage {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return newMessage(id, payload)
+}
+
+// parseIndexMessage returns the piece index of a have, suggest piece or allowed fast message.
+func parseIndexMessage(msg PeerMessage) (int, error) {
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("invalid %s payload length: %d", msg.ID, len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+// newPieceMessage returns a piece message carrying the block.
+func newPieceMessage(index, begin int, block []byte) PeerMessage {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return newMessage(MsgPiece, payload)
+}
+
+// parsePieceMessage returns the index, begin and block data of a piece message.
+func parsePieceMessage(msg PeerMessage) (int, int, []byte, error) {
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("piece message too short: %d bytes", len(msg.Payload))
+	}
+
+	// first 8 bytes are index and begin, then the block data
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
+// newPortMessage returns a port message with our DHT port.
+func newPortMessage(port int) PeerMessage {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(port))
+	return newMessage(MsgPort, payload)
+}
+
+// parsePortMessage returns the DHT port of a port message.
+func parsePortMessage(msg PeerMessage) (int, error) {
+	if len(msg.Payload) != 2 {
+		return 0, fmt.Errorf("invalid port payload length: %d", len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint16(msg.Payload)), nil
+}
+
+// newBitfieldMessage returns a bitfield message from the pieces we have.
+func newBitfieldMessage(have []bool) PeerMessage {
+	bitfield := make([]byte, (len(have)+7)/8)
+	for i, ok := range have {
+		if ok {
+			bitfield[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return newMessage(MsgBitfield, bitfield)
+}
+
+// hasBit reports whether the piece is set in the bitfield.
+func hasBit(bitfield []byte, index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bitfield) {
+		return false
+	}
+	return bitfield[byteIndex]>>(7-index%8)&1 == 1
+}
+
+// setBit sets the piece in the bitfield.
+func setBit(bitfield []byte, index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bitfield) {
+		return
+	}
+	bitfield[byteIndex] |= 1 << (7 - index%8)
+}
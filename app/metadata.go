@@ -0,0 +1,285 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+const (
+	// extensionHandshakeID is the extended message ID of the extension handshake.
+	extensionHandshakeID = 0
+	// utMetadataID is the extended message ID we advertise for ut_metadata.
+	utMetadataID = 1
+	// utPexID is the extended message ID we advertise for ut_pex.
+	utPexID = 2
+	// metadataPieceSize is the size of each metadata piece, except the last one.
+	metadataPieceSize = 16 * 1024
+	// maxMetadataSize protects us from peers announcing absurd metadata sizes.
+	maxMetadataSize = 8 * 1024 * 1024
+)
+
+// ut_metadata message types.
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// ExtensionHandshake holds the information a peer sent in its BEP 10 extension handshake.
+type ExtensionHandshake struct {
+	// Extensions maps extension names to the message IDs the peer wants us to use
+	Extensions   map[string]int `bencode:"m"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// metadataMessage is the bencoded dictionary of a ut_metadata message; For data messages the metadata
+// piece follows it.
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// sendExtensionMessage sends a BEP 10 extension message with the given extended message ID.
+func sendExtensionMessage(conn net.Conn, extendedID int, payload []byte) error {
+	return sendPeerMessage(conn, newMessage(MsgExtended, append([]byte{byte(extendedID)}, payload...)))
+}
+
+// receiveExtensionMessage reads peer messages until an extension message arrives,
+// and returns its extended message ID and payload.
+func receiveExtensionMessage(conn net.Conn) (int, []byte, error) {
+	for {
+		msg, err := recievePeerMessage(conn)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to read extension message: %v", err)
+		}
+
+		// Peers may send bitfield or have messages before the extension messages
+		if msg.ID != MsgExtended {
+			continue
+		}
+		if len(msg.Payload) < 1 {
+			return 0, nil, fmt.Errorf("empty extension message")
+		}
+
+		return int(msg.Payload[0]), msg.Payload[1:], nil
+	}
+}
+
+// PerformExtensionHandshake sends our extension handshake and reads the one from the peer.
+// The peer must have set the extension bit in its handshake.
+func PerformExtensionHandshake(conn net.Conn) (ExtensionHandshake, error) {
+	err := sendExtensionHandshake(conn, map[string]int{"ut_metadata": utMetadataID})
+	if err != nil {
+		return ExtensionHandshake{}, err
+	}
+
+	for {
+		id, payload, err := receiveExtensionMessage(conn)
+		if err != nil {
+			return ExtensionHandshake{}, err
+		}
+		if id != extensionHandshakeID {
+			continue
+		}
+		return parseExtensionHandshake(payload)
+	}
+}
+
+// sendExtensionHandshake sends our extension handshake, advertising the extensions with the message IDs the peer must use.
+func sendExtensionHandshake(conn net.Conn, extensions map[string]int) error {
+	payload, err := bencode.Marshal(ExtensionHandshake{Extensions: extensions})
+	if err != nil {
+		return err
+	}
+
+	err = sendExtensionMessage(conn, extensionHandshakeID, payload)
+	if err != nil {
+		return fmt.Errorf("failed to send extension handshake: %v", err)
+	}
+	return nil
+}
+
+// parseExtensionHandshake decodes the bencoded dictionary of an extension handshake; Many clients send
+// it with unsorted keys.
+func parseExtensionHandshake(payload []byte) (ExtensionHandshake, error) {
+	var handshake ExtensionHandshake
+	err := bencode.UnmarshalLenient(payload, &handshake)
+	if err != nil {
+		return ExtensionHandshake{}, fmt.Errorf("failed to decode extension handshake: %v", err)
+	}
+
+	result := ExtensionHandshake{Extensions: make(map[string]int), MetadataSize: handshake.MetadataSize}
+	for name, id := range handshake.Extensions {
+		// An ID of 0 means the extension is disabled
+		if id > 0 {
+			result.Extensions[name] = id
+		}
+	}
+
+	return result, nil
+}
+
+// requestMetadataPiece sends a ut_metadata request for the given metadata piece.
+func requestMetadataPiece(conn net.Conn, peerMetadataID, piece int) error {
+	request, err := bencode.Marshal(metadataMessage{MsgType: metadataRequest, Piece: piece})
+	if err != nil {
+		return err
+	}
+	return sendExtensionMessage(conn, peerMetadataID, request)
+}
+
+// receiveMetadataPiece reads the ut_metadata data message for the given metadata piece.
+func receiveMetadataPiece(conn net.Conn, piece int) ([]byte, error) {
+	for {
+		id, payload, err := receiveExtensionMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if id != utMetadataID {
+			continue
+		}
+
+		// Missing keys keep the invalid -1
+		header := metadataMessage{MsgType: -1, Piece: -1}
+		decoder := bencode.NewDecoder(bytes.NewReader(payload))
+		err = decoder.Decode(&header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode metadata message: %v", err)
+		}
+		if header.MsgType < 0 {
+			return nil, fmt.Errorf("metadata message has no msg_type")
+		}
+		if header.Piece != piece {
+			return nil, fmt.Errorf("unexpected metadata piece in response")
+		}
+
+		switch header.MsgType {
+		case metadataData:
+			return payload[decoder.InputOffset():], nil
+		case metadataReject:
+			return nil, fmt.Errorf("peer rejected metadata piece %d", piece)
+		default:
+			return nil, fmt.Errorf("unexpected metadata message type: %d", header.MsgType)
+		}
+	}
+}
+
+// DownloadMetadata downloads the info dictionary from a peer which completed the extension handshake,
+// and checks it against the info hash.
+func DownloadMetadata(conn net.Conn, handshake ExtensionHandshake, infoHash []byte) ([]byte, error) {
+	peerMetadataID, ok := handshake.Extensions["ut_metadata"]
+	if !ok {
+		return nil, fmt.Errorf("peer doesn't support ut_metadata")
+	}
+	if handshake.MetadataSize <= 0 || handshake.MetadataSize > maxMetadataSize {
+		return nil, fmt.Errorf("invalid metadata size: %d", handshake.MetadataSize)
+	}
+
+	metadata := make([]byte, 0, handshake.MetadataSize)
+	numPieces := (handshake.MetadataSize + metadataPieceSize - 1) / metadataPieceSize
+	for i := 0; i < numPieces; i++ {
+		err := requestMetadataPiece(conn, peerMetadataID, i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to request metadata piece: %v", err)
+		}
+
+		piece, err := receiveMetadataPiece(conn, i)
+		if err != nil {
+			return nil, err
+		}
+
+		expectedLen := min(metadataPieceSize, handshake.MetadataSize-i*metadataPieceSize)
+		if len(piece) != expectedLen {
+			return nil, fmt.Errorf("unexpected metadata piece size: expected %d, got %d", expectedLen, len(piece))
+		}
+		metadata = append(metadata, piece...)
+	}
+
+	hash := sha1.Sum(metadata)
+	if !bytes.Equal(hash[:], infoHash) {
+		return nil, fmt.Errorf("metadata hash mismatch: expected %x, got %x", infoHash, hash)
+	}
+
+	return metadata, nil
+}
+
+// FetchMagnetMetaInfo downloads the info dictionary of a magnet link from its peers, and returns the MetaInfo.
+func FetchMagnetMetaInfo(info MagnetMetaInfo) (MetaInfo, error) {
+	peers, err := GetMagnetPeers(info)
+	if err != nil {
+		return MetaInfo{}, fmt.Errorf("failed to get peers: %v", err)
+	}
+
+	for _, peer := range peers {
+		log.Printf("Trying peer: %s", peer)
+		metaInfo, err := fetchMetaInfoFromPeer(peer, info)
+		if err == nil {
+			log.Printf("Successfully fetched metadata from peer %s", peer)
+			return metaInfo, nil
+		}
+		log.Printf("Failed with peer %s: %v, trying next...", peer, err)
+	}
+
+	return MetaInfo{}, fmt.Errorf("failed to fetch metadata from all peers")
+}
+
+// MagnetHandshake connects to the peer and does the handshake, then the extension handshake; The caller
+// closes the connection. We tell a peer with the Fast Extension that we have no pieces before.
+func MagnetHandshake(peer string, infoHash []byte) (net.Conn, PeerHandshake, ExtensionHandshake, error) {
+	conn, err := net.DialTimeout("tcp", peer, 5*time.Second)
+	if err != nil {
+		return nil, PeerHandshake{}, ExtensionHandshake{}, err
+	}
+
+	peerHandshake, err := HandshakePeer(conn, infoHash)
+	if err != nil {
+		conn.Close()
+		return nil, PeerHandshake{}, ExtensionHandshake{}, err
+	}
+	if !peerHandshake.Extensions {
+		conn.Close()
+		return nil, PeerHandshake{}, ExtensionHandshake{}, fmt.Errorf("peer does not support the extension protocol")
+	}
+	err = sendHaveNone(conn, peerHandshake)
+	if err != nil {
+		conn.Close()
+		return nil, PeerHandshake{}, ExtensionHandshake{}, err
+	}
+
+	handshake, err := PerformExtensionHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, PeerHandshake{}, ExtensionHandshake{}, err
+	}
+	return conn, peerHandshake, handshake, nil
+}
+
+// fetchMetaInfoFromPeer downloads the info dictionary from a single peer.
+func fetchMetaInfoFromPeer(peer string, info MagnetMetaInfo) (MetaInfo, error) {
+	conn, _, handshake, err := MagnetHandshake(peer, info.InfoHash)
+	if err != nil {
+		return MetaInfo{}, err
+	}
+	defer conn.Close()
+
+	metadata, err := DownloadMetadata(conn, handshake, info.InfoHash)
+	if err != nil {
+		return MetaInfo{}, err
+	}
+
+	result, err := ParseInfoDict(metadata)
+	if err != nil {
+		return MetaInfo{}, err
+	}
+	result.TrackerUrl = info.TrackerUrl
+	result.AnnounceList = info.TrackerTiers()
+
+	return result, nil
+}
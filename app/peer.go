@@ -1,175 +1,156 @@
 package app
 
 import (
-	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
-	"time"
 )
 
 // PieceLength is the length of each piece in bytes.
 const PieceLength = 16 * 1024
 
+// DefaultPipelineDepth is the number of block requests kept in flight with each peer by default.
+const DefaultPipelineDepth = 5
+
+// DownloadOptions holds the optional settings of a download.
+type DownloadOptions struct {
+	// PipelineDepth is the number of block requests kept in flight with each peer; It defaults to DefaultPipelineDepth
+	PipelineDepth int
+}
+
+// pipelineDepth returns the pipeline depth of the download.
+func (opts DownloadOptions) pipelineDepth() int {
+	if opts.PipelineDepth <= 0 {
+		return DefaultPipelineDepth
+	}
+	return opts.PipelineDepth
+}
+
 // PeerMessage represents a message from/to a peer.
 type PeerMessage struct {
 	Length  int
-	ID      int
+	ID      MessageID
 	Payload []byte
 }
 
-// DownloadFile downloads the whole file the torrent file; And saves each piece in a temp file.
-// Then merge all the pieces to create the final file.
-func DownloadFile(info MetaInfo, path string) error {
-	errors := make(chan error)
-	for i := range info.Pieces {
-		// Download the piece
-		go func(i int) {
-			errors <- DownloadPiece(info, i, fmt.Sprintf("%s_temp_%d", path, i))
-		}(i)
-	}
+// DownloadFile downloads the whole file the torrent file; Each verified piece is written
+// at its offset in the final file, which is allocated to its full size up front.
+// For multi-file torrents, the files are created inside `path/<torrent name>/`.
+func DownloadFile(info MetaInfo, path string, opts DownloadOptions) error {
+	return downloadFile(info, path, false, opts)
+}
 
-	// Wait for all the pieces to download
-	finished := 0
-	for err := range errors {
-		if err != nil {
-			return fmt.Errorf("failed to download piece: %v", err)
-		}
-		finished++
-		if finished == len(info.Pieces) {
-			log.Println("All pieces downloaded successfully")
-			close(errors)
-		}
-	}
+// ResumeDownload continues an interrupted DownloadFile; Pieces already on disk are checked
+// against their hashes, and only the missing or corrupt ones are downloaded.
+func ResumeDownload(info MetaInfo, path string, opts DownloadOptions) error {
+	return downloadFile(info, path, true, opts)
+}
 
-	err := mergePieces(len(info.Pieces), path)
-	if err != nil {
-		return fmt.Errorf("failed to merge pieces: %v", err)
+func downloadFile(info MetaInfo, path string, resume bool, opts DownloadOptions) error {
+	var state *resumeState
+	if resume {
+		state = loadResumeState(info, path)
+	} else {
+		state = newResumeState(info, path)
 	}
 
-	return nil
-}
-
-// Tries downloading a piece from multiple peers if needed.
-func DownloadPiece(info MetaInfo, index int, path string) error {
-	peers, err := GetPeers(info)
+	storage, err := NewFileStorage(info, path, !resume)
 	if err != nil {
-		return fmt.Errorf("failed to get peers: %v", err)
+		return err
 	}
+	defer storage.Close()
 
-	for _, peer := range peers {
-		log.Printf("Trying peer: %s", peer)
-		err := downloadPieceFromPeer(peer, info, index, path)
-		if err == nil {
-			log.Printf("Successfully downloaded piece %d from peer %s", index, peer)
-			return nil
-		}
-		log.Printf("Failed with peer %s, trying next...", peer)
+	if resume {
+		checkExistingPieces(storage, state)
 	}
 
-	return fmt.Errorf("failed to download piece %d from all peers", index)
-}
+	err = downloadToStorage(info, storage, opts, state.MarkCompleted)
 
-// GetPeers returns list of all available peers asking from the tracker.
-func GetPeers(info MetaInfo) ([]string, error) {
-	params := url.Values{}
-	params.Add("info_hash", string(info.InfoHash))
-	params.Add("peer_id", GenerateRandomID(20))
-	params.Add("port", "6881")
-	params.Add("uploaded", "0")
-	params.Add("downloaded", "0")
-	params.Add("left", fmt.Sprintf("%d", info.Length))
-	params.Add("compact", "1")
-
-	fullUrl := info.TrackerUrl + "?" + params.Encode()
-
-	resp, err := http.Get(fullUrl)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+	// Keep the progress even if the download failed, so it can be resumed
+	syncErr := storage.Sync()
+	if syncErr == nil {
+		syncErr = state.Save()
 	}
-
-	decoded, err := DecodeBencode(string(body))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode response body: %v", err)
+		return err
 	}
-
-	// Parse peers URL with ports; Each peer is 6 bytes, 4 bytes URL 2 bytes port
-	peersStr := decoded.Dict["peers"].Str
-	peers := make([]string, 0)
-	for i := 0; i < len(peersStr); i += 6 {
-		peer := peersStr[i : i+6]
-		peerUrl := fmt.Sprintf("%d.%d.%d.%d", peer[0], peer[1], peer[2], peer[3])
-		peerPort := int(peer[4])*256 + int(peer[5])
-		peers = append(peers, fmt.Sprintf("%s:%d", peerUrl, peerPort))
+	if syncErr != nil {
+		return syncErr
 	}
 
-	return peers, nil
+	state.Remove()
+	return nil
 }
 
-// HandshakePeer performs the BitTorrent handshake and returns the peer ID.
-func HandshakePeer(conn net.Conn, info MetaInfo) ([]byte, error) {
-	// Write handshake message
-	var msg bytes.Buffer
-	msg.WriteByte(19)
-	msg.WriteString("BitTorrent protocol")
-	msg.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0})
-	msg.Write(info.InfoHash)
-	msg.WriteString(GenerateRandomID(20))
-
-	_, err := conn.Write(msg.Bytes())
-	if err != nil {
-		return nil, fmt.Errorf("failed to send handshake message: %v", err)
-	}
+// DownloadToStorage downloads every piece which is not complete in the storage yet.
+func DownloadToStorage(info MetaInfo, storage Storage, opts DownloadOptions) error {
+	return downloadToStorage(info, storage, opts, nil)
+}
 
-	// Read handshake response (exactly 68 bytes)
-	resp, err := readExactBytes(conn, 68)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read handshake response: %v", err)
+// downloadToStorage downloads the missing pieces to the storage; onComplete, if set, is called after each piece is stored.
+func downloadToStorage(info MetaInfo, storage Storage, opts DownloadOptions, onComplete func(index int) error) error {
+	pieces := make([]int, 0, len(info.Pieces))
+	for i := range info.Pieces {
+		if !storage.Completed(i) {
+			pieces = append(pieces, i)
+		}
 	}
-
-	if resp[0] != 19 {
-		return nil, fmt.Errorf("invalid handshake response")
+	log.Printf("%d of %d pieces to download", len(pieces), len(info.Pieces))
+
+	if len(pieces) > 0 {
+		err := downloadPieces(info, pieces, opts, func(index int, data []byte) error {
+			err := writePiece(storage, index, data)
+			if err != nil {
+				return err
+			}
+			if onComplete != nil {
+				return onComplete(index)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to download pieces: %v", err)
+		}
 	}
-	peerID := resp[48:]
+	log.Println("All pieces downloaded successfully")
 
-	return peerID, nil
+	return syncStorage(storage)
 }
 
-// mergePieces merges all the pieces to create the final file.
-func mergePieces(numOfPieces int, path string) error {
-	// Final file
-	file, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
+// DownloadPiece downloads a single piece, trying multiple peers if needed.
+func DownloadPiece(info MetaInfo, index int, path string, opts DownloadOptions) error {
+	if index < 0 || index >= len(info.Pieces) {
+		return fmt.Errorf("piece index %d out of range", index)
 	}
-	defer file.Close()
 
-	// Merge all the pieces
-	for i := range numOfPieces {
-		pieceFile, err := os.Open(fmt.Sprintf("%s_temp_%d", path, i))
-		if err != nil {
-			return fmt.Errorf("failed to open piece file: %v", err)
-		}
-		defer pieceFile.Close()
+	return downloadPieces(info, []int{index}, opts, func(index int, data []byte) error {
+		return os.WriteFile(path, data, 0644)
+	})
+}
 
-		_, err = io.Copy(file, pieceFile)
-		if err != nil {
-			return fmt.Errorf("failed to copy piece to file: %v", err)
-		}
-	}
+// GetPeers returns list of all available peers asking from the trackers of the torrent and the peer sources.
+func GetPeers(info MetaInfo) ([]string, error) {
+	return findPeers(info.TrackerTiers(), AnnounceRequest{
+		InfoHash: info.InfoHash,
+		PeerID:   GenerateRandomID(20),
+		Port:     DefaultPort,
+		Left:     info.Length,
+	})
+}
 
-	return nil
+// parseCompactPeers parses peers in compact format; Each peer is 6 bytes, 4 bytes URL 2 bytes port.
+func parseCompactPeers(peersStr string) []string {
+	peers := make([]string, 0)
+	for i := 0; i+6 <= len(peersStr); i += 6 {
+		peer := peersStr[i : i+6]
+		peerUrl := fmt.Sprintf("%d.%d.%d.%d", peer[0], peer[1], peer[2], peer[3])
+		peerPort := int(peer[4])*256 + int(peer[5])
+		peers = append(peers, fmt.Sprintf("%s:%d", peerUrl, peerPort))
+	}
+	return peers
 }
 
 // readExactBytes reads exactly 'size' bytes from the connection.
@@ -182,213 +163,58 @@ func readExactBytes(conn net.Conn, size int) ([]byte, error) {
 	return buf, nil
 }
 
-// recievePeerMessage reads a PeerMessage from a peer.
+// maxMessageLength protects us from peers announcing absurd message lengths.
+const maxMessageLength = 1024 * 1024
+
+// recievePeerMessage reads a PeerMessage from a peer; Keep-alive messages have the MsgKeepAlive ID.
 func recievePeerMessage(conn net.Conn) (PeerMessage, error) {
 	// Read message length (4 bytes)
 	lengthBytes, err := readExactBytes(conn, 4)
 	if err != nil {
 		return PeerMessage{}, fmt.Errorf("failed to read message length: %v", err)
 	}
-	length := int(lengthBytes[0])<<24 | int(lengthBytes[1])<<16 | int(lengthBytes[2])<<8 | int(lengthBytes[3])
+	length := int(binary.BigEndian.Uint32(lengthBytes))
 
-	// Read message ID (1 byte)
-	idBytes, err := readExactBytes(conn, 1)
-	if err != nil {
-		return PeerMessage{}, fmt.Errorf("failed to read message ID: %v", err)
+	// Keep-alive messages have no ID nor payload
+	if length == 0 {
+		return PeerMessage{Length: 0, ID: MsgKeepAlive}, nil
+	}
+	if length > maxMessageLength {
+		return PeerMessage{}, fmt.Errorf("message too long: %d bytes", length)
 	}
-	id := int(idBytes[0])
 
-	// Read message payload (length - 1 bytes)
-	payload, err := readExactBytes(conn, length-1)
+	// Read message ID (1 byte) and payload (length - 1 bytes)
+	body, err := readExactBytes(conn, length)
 	if err != nil {
-		return PeerMessage{}, fmt.Errorf("failed to read message payload: %v", err)
+		return PeerMessage{}, fmt.Errorf("failed to read message: %v", err)
 	}
 
-	return PeerMessage{Length: length, ID: id, Payload: payload}, nil
+	return PeerMessage{Length: length, ID: MessageID(body[0]), Payload: body[1:]}, nil
 }
 
-// sendPeerMessage sends a PeerMessage to a peer.
+// sendPeerMessage sends a PeerMessage to a peer in a single write.
 func sendPeerMessage(conn net.Conn, msg PeerMessage) error {
-	// Write message length
-	lengthBytes := []byte{byte(msg.Length >> 24), byte(msg.Length >> 16), byte(msg.Length >> 8), byte(msg.Length)}
-	_, err := conn.Write(lengthBytes)
-	if err != nil {
-		return fmt.Errorf("failed to write message length: %v", err)
+	buf := make([]byte, 4, 5+len(msg.Payload))
+	binary.BigEndian.PutUint32(buf, uint32(msg.Length))
+	if msg.ID != MsgKeepAlive {
+		buf = append(buf, byte(msg.ID))
+		buf = append(buf, msg.Payload...)
 	}
 
-	// Write message ID
-	_, err = conn.Write([]byte{byte(msg.ID)})
+	_, err := conn.Write(buf)
 	if err != nil {
-		return fmt.Errorf("failed to write message ID: %v", err)
-	}
-
-	// Write message payload
-	_, err = conn.Write(msg.Payload)
-	if err != nil {
-		return fmt.Errorf("failed to write message payload: %v", err)
+		return fmt.Errorf("failed to write %s message: %v", msg.ID, err)
 	}
 
 	return nil
 }
 
-// readBitFieldMessage reads the bitfield message from a peer.
-func readBitFieldMessage(conn net.Conn) (PeerMessage, error) {
-	msg, err := recievePeerMessage(conn)
-	if err != nil {
-		return PeerMessage{}, fmt.Errorf("failed to read bitfield message: %v", err)
-	}
-
-	if msg.ID != 5 {
-		return PeerMessage{}, fmt.Errorf("expected bitfield message 5, got: %d", msg.ID)
-	}
-
-	return msg, nil
-}
-
 // sendInterestedMessage sends the interested message to a peer.
 func sendInterestedMessage(conn net.Conn) error {
-	msg := PeerMessage{Length: 1, ID: 2}
-	return sendPeerMessage(conn, msg)
-}
-
-// receiveUnchokeMessage reads the unchoke message from a peer.
-func receiveUnchokeMessage(conn net.Conn) (PeerMessage, error) {
-	msg, err := recievePeerMessage(conn)
-	if err != nil {
-		return PeerMessage{}, fmt.Errorf("failed to read unchoke message: %v", err)
-	}
-
-	if msg.ID != 1 {
-		return PeerMessage{}, fmt.Errorf("expected unchoke message 1, got: %d", msg.ID)
-	}
-
-	return msg, nil
+	return sendPeerMessage(conn, newMessage(MsgInterested, nil))
 }
 
 // sendRequestMessage sends the request message to a peer.
 func sendRequestMessage(conn net.Conn, index, begin, length int) error {
-	msg := PeerMessage{
-		Length: 13,
-		ID:     6,
-		Payload: []byte{
-			byte(index >> 24), byte(index >> 16), byte(index >> 8), byte(index),
-			byte(begin >> 24), byte(begin >> 16), byte(begin >> 8), byte(begin),
-			byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length),
-		},
-	}
-
-	return sendPeerMessage(conn, msg)
-}
-
-// recievePieceMessage reads the piece message from a peer.
-func recievePieceMessage(conn net.Conn) ([]byte, error) {
-	msg, err := recievePeerMessage(conn)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read piece message: %v", err)
-	}
-
-	if msg.ID != 7 {
-		return nil, fmt.Errorf("expected piece message 7, got: %d", msg.ID)
-	}
-
-	// return block data of the payload; first 8 bytes are index, begin and block data
-	return msg.Payload[8:], nil
-}
-
-// downloadPiece downloads a piece from a peer.
-func downloadPiece(conn net.Conn, index, pieceLength, totalFileSize int) ([]byte, error) {
-	// Check if this is the last piece
-	isLastPiece := (index+1)*pieceLength >= totalFileSize
-
-	// Determine actual piece size for this index
-	totalPieceLen := pieceLength // Default to full size
-	if isLastPiece {
-		totalPieceLen = totalFileSize - (index * pieceLength) // Calculate remaining bytes
-	}
-
-	log.Printf("Downloading piece %d - Total Piece Length: %d, Is Last Piece: %v\n", index, totalPieceLen, isLastPiece)
-
-	buffer := make([]byte, totalPieceLen)
-
-	for i := 0; i < totalPieceLen; i += PieceLength {
-		// Determine block size dynamically
-		remainingSize := totalPieceLen - i
-		downloadLen := min(PieceLength, remainingSize)
-
-		err := sendRequestMessage(conn, index, i, downloadLen)
-		if err != nil {
-			return nil, fmt.Errorf("failed to send request message: %v", err)
-		}
-
-		block, err := recievePieceMessage(conn)
-		if err != nil {
-			return nil, fmt.Errorf("failed to receive piece message: %v", err)
-		}
-
-		if len(block) != downloadLen {
-			return nil, fmt.Errorf("unexpected block size: expected %d, got %d", downloadLen, len(block))
-		}
-
-		copy(buffer[i:i+downloadLen], block)
-	}
-
-	return buffer, nil
-}
-
-// Attempts to download a piece from a single peer.
-func downloadPieceFromPeer(peer string, info MetaInfo, index int, path string) error {
-	conn, err := net.DialTimeout("tcp", peer, 5*time.Second)
-	if err != nil {
-		log.Printf("Failed to connect to peer %s: %v", peer, err)
-		return err
-	}
-	defer conn.Close()
-
-	_, err = HandshakePeer(conn, info)
-	if err != nil {
-		log.Printf("Handshake failed with peer %s: %v", peer, err)
-		return err
-	}
-	log.Println("Handshake successful, downloading piece...")
-
-	// **Preserving all steps before downloading the piece**
-	_, err = readBitFieldMessage(conn)
-	if err != nil {
-		log.Printf("Failed to read bitfield from peer %s: %v", peer, err)
-		return err
-	}
-
-	err = sendInterestedMessage(conn)
-	if err != nil {
-		log.Printf("Failed to send interested message to peer %s: %v", peer, err)
-		return err
-	}
-
-	_, err = receiveUnchokeMessage(conn)
-	if err != nil {
-		log.Printf("Failed to receive unchoke message from peer %s: %v", peer, err)
-		return err
-	}
-
-	// Create a file to save the downloaded piece
-	file, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
-	}
-	defer file.Close()
-
-	// Download the piece
-	piece, err := downloadPiece(conn, index, info.PieceLength, info.Length)
-	if err != nil {
-		log.Printf("Failed to download piece from peer %s: %v", peer, err)
-		return err
-	}
-
-	// Write the downloaded piece to the file
-	_, err = file.Write(piece)
-	if err != nil {
-		return fmt.Errorf("failed to write piece to file: %v", err)
-	}
-
-	return nil
+	return sendPeerMessage(conn, newBlockMessage(MsgRequest, blockRequest{Index: index, Begin: begin, Length: length}))
 }
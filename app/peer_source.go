@@ -0,0 +1,169 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// PeerSource finds the peers of a torrent without its trackers, like the DHT.
+type PeerSource interface {
+	// FindPeers returns the peers of the torrent, and announces that we are one of them on the port;
+	// A port of 0 only looks the peers up.
+	FindPeers(infoHash []byte, port int) ([]string, error)
+}
+
+// waitingPeerSource is a PeerSource which waits for peers to show up, like LSD; findPeersUntil stops
+// waiting once found is closed, because another source found peers.
+type waitingPeerSource interface {
+	findPeersUntil(infoHash []byte, port int, found <-chan struct{}) ([]string, error)
+}
+
+// peerSources are the sources registered with AddPeerSource.
+var peerSources = struct {
+	mu      sync.Mutex
+	sources []PeerSource
+}{}
+
+// AddPeerSource registers a source which GetPeers and GetMagnetPeers query next to the trackers.
+func AddPeerSource(source PeerSource) {
+	peerSources.mu.Lock()
+	defer peerSources.mu.Unlock()
+	peerSources.sources = append(peerSources.sources, source)
+}
+
+// findPeers announces to the trackers and queries the registered peer sources at the same time.
+// It returns the peers found by all of them, and only fails if none of them found any. The peer sources
+// are not announced to, since nothing listens on the port of a download; AnnounceToPeerSources does that.
+func findPeers(tiers [][]string, req AnnounceRequest) ([]string, error) {
+	peerSources.mu.Lock()
+	sources := append([]PeerSource(nil), peerSources.sources...)
+	peerSources.mu.Unlock()
+
+	if len(tiers) == 0 && len(sources) == 0 {
+		return nil, fmt.Errorf("torrent has no trackers")
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	found := make([]string, 0)
+	var lastErr error
+	// anyFound is closed once a tracker or source found peers
+	anyFound := make(chan struct{})
+	collect := func(peers []string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			lastErr = err
+			return
+		}
+		if len(found) == 0 && len(peers) > 0 {
+			close(anyFound)
+		}
+		found = append(found, peers...)
+	}
+
+	if len(tiers) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := trackersFor(req.InfoHash, tiers).Announce(req)
+			collect(resp.Peers, err)
+		}()
+	}
+	for _, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var peers []string
+			var err error
+			if waiting, ok := source.(waitingPeerSource); ok {
+				peers, err = waiting.findPeersUntil(req.InfoHash, 0, anyFound)
+			} else {
+				peers, err = source.FindPeers(req.InfoHash, 0)
+			}
+			if err != nil {
+				log.Printf("Failed to find peers: %v", err)
+			}
+			collect(peers, err)
+		}()
+	}
+	wg.Wait()
+
+	// The same peer may be known to several sources
+	seen := make(map[string]bool)
+	peers := make([]string, 0, len(found))
+	for _, peer := range found {
+		if !seen[peer] {
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+
+	if len(peers) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return peers, nil
+}
+
+// AnnounceToPeerSources tells the registered peer sources that we serve the torrent on the port, like
+// when seeding, without waiting for them.
+func AnnounceToPeerSources(infoHash []byte, port int) {
+	peerSources.mu.Lock()
+	sources := append([]PeerSource(nil), peerSources.sources...)
+	peerSources.mu.Unlock()
+
+	for _, source := range sources {
+		go func() {
+			_, err := source.FindPeers(infoHash, port)
+			if err != nil {
+				log.Printf("Failed to announce: %v", err)
+			}
+		}()
+	}
+}
+
+// peerWatchers are called with the peers a source discovers on its own, like LSD, by info hash.
+var peerWatchers = struct {
+	mu       sync.Mutex
+	next     int
+	watchers map[string]map[int]func(peers []string)
+}{watchers: make(map[string]map[int]func(peers []string))}
+
+// watchPeers calls onPeers with the peers discovered for the torrent, until stop is called.
+func watchPeers(infoHash []byte, onPeers func(peers []string)) (stop func()) {
+	peerWatchers.mu.Lock()
+	defer peerWatchers.mu.Unlock()
+
+	id := peerWatchers.next
+	peerWatchers.next++
+	watchers, ok := peerWatchers.watchers[string(infoHash)]
+	if !ok {
+		watchers = make(map[int]func(peers []string))
+		peerWatchers.watchers[string(infoHash)] = watchers
+	}
+	watchers[id] = onPeers
+
+	return func() {
+		peerWatchers.mu.Lock()
+		defer peerWatchers.mu.Unlock()
+		delete(watchers, id)
+		if len(watchers) == 0 {
+			delete(peerWatchers.watchers, string(infoHash))
+		}
+	}
+}
+
+// discoveredPeers passes peers a source discovered on its own to the watchers of the torrent.
+func discoveredPeers(infoHash []byte, peers []string) {
+	peerWatchers.mu.Lock()
+	callbacks := make([]func(peers []string), 0)
+	for _, onPeers := range peerWatchers.watchers[string(infoHash)] {
+		callbacks = append(callbacks, onPeers)
+	}
+	peerWatchers.mu.Unlock()
+
+	for _, onPeers := range callbacks {
+		onPeers(peers)
+	}
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// Peer exchange (BEP 11) constants.
+const (
+	// pexInterval is the minimum time between two PEX messages to the same peer.
+	pexInterval = time.Minute
+	// pexMaxPeers is the maximum number of added, and of dropped, peers in a PEX message.
+	pexMaxPeers = 50
+	// pexFlagReachable marks a peer we connected to, so it accepts incoming connections.
+	pexFlagReachable = 0x10
+)
+
+// pexMessage is the payload of a ut_pex message; Peers are in compact format.
+type pexMessage struct {
+	Added      string `bencode:"added"`
+	AddedFlags string `bencode:"added.f"`
+	Dropped    string `bencode:"dropped"`
+}
+
+// pexState tracks the peers we told a peer about, so every PEX message only holds the changes.
+type pexState struct {
+	sent     map[string]bool
+	lastSent time.Time
+}
+
+// next returns the PEX message with the peers connected and dropped since the last message, and records
+// them as sent. It reports false if the last message is too recent, or if nothing changed.
+func (s *pexState) next(connected []string) (pexMessage, bool) {
+	if time.Since(s.lastSent) < pexInterval {
+		return pexMessage{}, false
+	}
+	if s.sent == nil {
+		s.sent = make(map[string]bool)
+	}
+
+	var msg pexMessage
+	current := make(map[string]bool, len(connected))
+	added := 0
+	for _, peer := range connected {
+		current[peer] = true
+		if s.sent[peer] || added == pexMaxPeers {
+			continue
+		}
+		compact, ok := compactPeerAddr(peer)
+		if !ok {
+			continue
+		}
+		msg.Added += compact
+		msg.AddedFlags += string([]byte{pexFlagReachable})
+		s.sent[peer] = true
+		added++
+	}
+
+	dropped := 0
+	for peer := range s.sent {
+		if current[peer] || dropped == pexMaxPeers {
+			continue
+		}
+		compact, _ := compactPeerAddr(peer)
+		msg.Dropped += compact
+		delete(s.sent, peer)
+		dropped++
+	}
+
+	if added == 0 && dropped == 0 {
+		return pexMessage{}, false
+	}
+	s.lastSent = time.Now()
+	return msg, true
+}
+
+// compactPeerAddr encodes an "ip:port" IPv4 peer address in compact format.
+func compactPeerAddr(peer string) (string, bool) {
+	host, portStr, err := net.SplitHostPort(peer)
+	if err != nil {
+		return "", false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", false
+	}
+	return encodeCompactPeer(net.ParseIP(host), port)
+}
+
+// parsePexMessage returns the peers added by a ut_pex message. Dropped peers are ignored; They may
+// only have lost the connection with the sender, so they stay candidates.
+func parsePexMessage(payload []byte) ([]string, error) {
+	var msg pexMessage
+	err := bencode.UnmarshalLenient(payload, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pex message: %v", err)
+	}
+
+	peers := parseCompactPeers(msg.Added)
+	if len(peers) > pexMaxPeers {
+		peers = peers[:pexMaxPeers]
+	}
+	return peers, nil
+}
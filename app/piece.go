@@ -0,0 +1,46 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"sync"
+)
+
+// verifyPiece checks the downloaded piece against its SHA-1 hash from the torrent file.
+func verifyPiece(info MetaInfo, index int, piece []byte) error {
+	if index < 0 || index >= len(info.Pieces) {
+		return fmt.Errorf("piece index %d out of range", index)
+	}
+
+	hash := sha1.Sum(piece)
+	if !bytes.Equal(hash[:], []byte(info.Pieces[index])) {
+		return fmt.Errorf("piece %d hash mismatch: expected %x, got %x", index, info.Pieces[index], hash)
+	}
+
+	return nil
+}
+
+// peerBanList keeps track of peers that sent us corrupt data, so they are not asked again.
+type peerBanList struct {
+	mu    sync.Mutex
+	peers map[string]bool
+}
+
+func newPeerBanList() *peerBanList {
+	return &peerBanList{peers: make(map[string]bool)}
+}
+
+// Ban marks the peer as untrusted.
+func (b *peerBanList) Ban(peer string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.peers[peer] = true
+}
+
+// IsBanned reports whether the peer has been marked as untrusted.
+func (b *peerBanList) IsBanned(peer string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.peers[peer]
+}
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// resumeSaveInterval is the minimum time between two writes of the fast-resume file.
+const resumeSaveInterval = time.Second
+
+// fileStamp identifies the content of an output file without hashing it.
+type fileStamp struct {
+	Size    int   `bencode:"size"`
+	ModTime int64 `bencode:"mtime"`
+}
+
+// resumeFile is the content of the fast-resume file.
+type resumeFile struct {
+	InfoHash string      `bencode:"info hash"`
+	Have     []byte      `bencode:"have"`
+	Files    []fileStamp `bencode:"files"`
+}
+
+// resumeState is the fast-resume sidecar of a download, saved as bencode in `<path>.resume`.
+// It records the completed pieces with the size and modification time of the output files,
+// so the pieces don't have to be hashed again on resume if the files didn't change since.
+type resumeState struct {
+	mu        sync.Mutex
+	path      string
+	info      MetaInfo
+	files     []FileInfo
+	completed []bool
+	stamps    []fileStamp
+	lastSave  time.Time
+	// loaded is set if the state was read from a fast-resume file
+	loaded bool
+}
+
+// resumePath returns the path of the fast-resume file of a download.
+func resumePath(path string) string {
+	return path + ".resume"
+}
+
+// newResumeState returns an empty resume state for the download.
+func newResumeState(info MetaInfo, path string) *resumeState {
+	return &resumeState{
+		path:      resumePath(path),
+		info:      info,
+		files:     outputFiles(info, path),
+		completed: make([]bool, len(info.Pieces)),
+	}
+}
+
+// loadResumeState reads the fast-resume file of the download; A missing or invalid file gives an empty state.
+func loadResumeState(info MetaInfo, path string) *resumeState {
+	state := newResumeState(info, path)
+
+	data, err := os.ReadFile(state.path)
+	if err != nil {
+		return state
+	}
+
+	var saved resumeFile
+	err = bencode.Unmarshal(data, &saved)
+	if err != nil {
+		log.Printf("Ignoring invalid resume file %s: %v", state.path, err)
+		return state
+	}
+	if saved.InfoHash != string(info.InfoHash) {
+		log.Printf("Ignoring resume file %s of another torrent", state.path)
+		return state
+	}
+	if len(saved.Files) != len(state.files) {
+		log.Printf("Ignoring invalid resume file %s", state.path)
+		return state
+	}
+
+	state.stamps = saved.Files
+	state.loaded = true
+	for i := range state.completed {
+		state.completed[i] = hasBit(saved.Have, i)
+	}
+
+	return state
+}
+
+// currentStamps returns the stamps of the output files as they are on disk now.
+func (r *resumeState) currentStamps() ([]fileStamp, error) {
+	stamps := make([]fileStamp, 0, len(r.files))
+	for _, f := range r.files {
+		stat, err := os.Stat(filepath.Join(f.Path...))
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{Size: int(stat.Size()), ModTime: stat.ModTime().UnixNano()})
+	}
+	return stamps, nil
+}
+
+// filesUnchanged reports whether the output files are exactly as they were on the last save.
+func (r *resumeState) filesUnchanged() bool {
+	current, err := r.currentStamps()
+	if err != nil || len(current) != len(r.stamps) {
+		return false
+	}
+	for i := range current {
+		if current[i] != r.stamps[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// MarkCompleted records the piece as complete and saves the state if the last save is old enough.
+func (r *resumeState) MarkCompleted(index int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.completed[index] = true
+
+	if time.Since(r.lastSave) < resumeSaveInterval {
+		return nil
+	}
+	return r.save()
+}
+
+// Save writes the state to the fast-resume file.
+func (r *resumeState) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.save()
+}
+
+// save writes the state to a temp file and renames it, so a crash never leaves a half written file; r.mu must be held.
+func (r *resumeState) save() error {
+	stamps, err := r.currentStamps()
+	if err != nil {
+		return fmt.Errorf("failed to stat output files: %v", err)
+	}
+
+	data, err := bencode.Marshal(resumeFile{
+		InfoHash: string(r.info.InfoHash),
+		Have:     newBitfieldMessage(r.completed).Payload,
+		Files:    stamps,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode resume file: %v", err)
+	}
+
+	tmpPath := r.path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write resume file: %v", err)
+	}
+	err = os.Rename(tmpPath, r.path)
+	if err != nil {
+		return fmt.Errorf("failed to write resume file: %v", err)
+	}
+
+	r.stamps = stamps
+	r.lastSave = time.Now()
+	return nil
+}
+
+// Remove deletes the fast-resume file once the download is complete.
+func (r *resumeState) Remove() {
+	os.Remove(r.path)
+}
+
+// checkExistingPieces checks the partial download in the storage, and marks the valid pieces complete.
+// If the output files didn't change since the last save, the completed pieces are trusted without hashing.
+// Otherwise, as after a crash, only the pieces recorded as complete are hashed again; Every piece is hashed
+// without a fast-resume file.
+func checkExistingPieces(storage Storage, state *resumeState) {
+	trusted := state.loaded && state.filesUnchanged()
+	if state.loaded && !trusted {
+		log.Println("Output files changed since the last save, checking the completed pieces")
+	}
+
+	for i := range state.info.Pieces {
+		if trusted && state.completed[i] {
+			storage.MarkComplete(i)
+			continue
+		}
+		if state.loaded && !state.completed[i] {
+			continue
+		}
+
+		data, err := readPiece(storage, state.info, i)
+		if err == nil && verifyPiece(state.info, i, data) == nil {
+			state.completed[i] = true
+			storage.MarkComplete(i)
+			continue
+		}
+
+		state.completed[i] = false
+	}
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestResumeDownload writes a single-file torrent of three valid 4-byte pieces to a temp dir, and
+// returns its MetaInfo and path.
+func newTestResumeDownload(t *testing.T) (MetaInfo, string) {
+	t.Helper()
+	data := []byte("aaaabbbbcccc")
+	info := MetaInfo{Name: "data", Length: len(data), InfoHash: make([]byte, 20), PieceLength: 4}
+	for i := 0; i < len(data); i += info.PieceLength {
+		hash := sha1.Sum(data[i : i+info.PieceLength])
+		info.Pieces = append(info.Pieces, string(hash[:]))
+	}
+
+	path := filepath.Join(t.TempDir(), "data")
+	err := os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return info, path
+}
+
+// checkResumedPieces runs checkExistingPieces on the download and returns the completed pieces.
+func checkResumedPieces(t *testing.T, info MetaInfo, path string) []bool {
+	t.Helper()
+	storage, err := NewFileStorage(info, path, false)
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	defer storage.Close()
+
+	checkExistingPieces(storage, loadResumeState(info, path))
+	completed := make([]bool, len(info.Pieces))
+	for i := range completed {
+		completed[i] = storage.Completed(i)
+	}
+	return completed
+}
+
+func TestCheckExistingPieces(t *testing.T) {
+	info, path := newTestResumeDownload(t)
+
+	// Without a fast-resume file, every piece is hashed
+	if got := checkResumedPieces(t, info, path); got[0] != true || got[1] != true || got[2] != true {
+		t.Errorf("completed pieces without a resume file = %v, want all", got)
+	}
+
+	state := newResumeState(info, path)
+	state.completed[0] = true
+	state.completed[1] = true
+	err := state.Save()
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// The files didn't change: the recorded pieces are trusted, the others are left to download
+	err = os.WriteFile(path, []byte("aaaaXXXXcccc"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	stamp := time.Unix(0, state.stamps[0].ModTime)
+	err = os.Chtimes(path, stamp, stamp)
+	if err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if got := checkResumedPieces(t, info, path); got[0] != true || got[1] != true || got[2] != false {
+		t.Errorf("completed pieces with unchanged files = %v, want [true true false]", got)
+	}
+
+	// The files changed since the save, as after a crash: only the recorded pieces are hashed again
+	later := stamp.Add(time.Second)
+	err = os.Chtimes(path, later, later)
+	if err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if got := checkResumedPieces(t, info, path); got[0] != true || got[1] != false || got[2] != false {
+		t.Errorf("completed pieces with changed files = %v, want [true false false]", got)
+	}
+}
@@ -0,0 +1,887 @@
+package app
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Seeder limits.
+const (
+	// maxBlockRequestLength is the largest block a peer may request from us.
+	maxBlockRequestLength = 128 * 1024
+	// maxPendingRequests is the number of requests a peer may queue; Further requests are rejected with
+	// the Fast Extension, and make us disconnect without it.
+	maxPendingRequests = 250
+	// maxUnchokedPeers is the number of peers we upload to at the same time, including the optimistic unchoke.
+	maxUnchokedPeers = 4
+	// maxSeedConnections is the number of peers connected to us at the same time; Further connections are closed.
+	maxSeedConnections = 50
+	// seedWriteTimeout is how long a message may take to be written to a peer.
+	seedWriteTimeout = time.Minute
+	// seedKeepAliveInterval is how often we send a keep-alive to the peers; They drop silent peers after a few minutes.
+	seedKeepAliveInterval = 2 * time.Minute
+	// allowedFastSetSize is the number of pieces a choked peer may download with the Fast Extension, `k` in BEP 6.
+	allowedFastSetSize = 10
+	// seedSuggestedPieces is the number of recently served pieces suggested to an unchoked peer; They are
+	// likely still in the page cache.
+	seedSuggestedPieces = 4
+)
+
+// Seeder announce intervals.
+const (
+	// seedAnnounceInterval is how often the seeded torrents are announced when the trackers don't send an interval.
+	seedAnnounceInterval = 30 * time.Minute
+	// seedMinAnnounceInterval protects the trackers from intervals which are too short.
+	seedMinAnnounceInterval = time.Minute
+)
+
+// Seeder choking intervals.
+const (
+	// seedRechokeInterval is how often the upload slots go to the peers we upload to fastest.
+	seedRechokeInterval = 10 * time.Second
+	// seedOptimisticRechokes is the number of rechokes after which the optimistic unchoke goes to the next
+	// waiting peer, so every peer gets a chance to download.
+	seedOptimisticRechokes = 3
+)
+
+// seededTorrent is a torrent we serve to other peers.
+type seededTorrent struct {
+	info    MetaInfo
+	storage Storage
+	// ownStorage is set if the Seeder opened the storage, and closes it
+	ownStorage bool
+
+	mu sync.Mutex
+	// recentPieces are the pieces served last, most recent first
+	recentPieces []int
+}
+
+// servedPiece records that a block of the piece was served.
+func (t *seededTorrent) servedPiece(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	recent := []int{index}
+	for _, other := range t.recentPieces {
+		if other != index && len(recent) < seedSuggestedPieces {
+			recent = append(recent, other)
+		}
+	}
+	t.recentPieces = recent
+}
+
+// suggestedPieces returns the pieces to suggest to a peer.
+func (t *seededTorrent) suggestedPieces() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]int(nil), t.recentPieces...)
+}
+
+// Seeder accepts incoming peer connections and serves the pieces of completed torrents.
+type Seeder struct {
+	mu       sync.Mutex
+	torrents map[string]*seededTorrent
+	peerID   string
+	port     int
+
+	// unchoked are the peers holding one of the maxUnchokedPeers upload slots; Interested peers wait
+	// in order for a free slot, or for the optimistic unchoke
+	unchoked   map[*seedConn]bool
+	waiting    []*seedConn
+	optimistic *seedConn
+	rechokes   int
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSeeder returns a Seeder which will listen on the given port.
+func NewSeeder(port int) *Seeder {
+	return &Seeder{
+		torrents: make(map[string]*seededTorrent),
+		peerID:   GenerateRandomID(20),
+		port:     port,
+		unchoked: make(map[*seedConn]bool),
+		closed:   make(chan struct{}),
+	}
+}
+
+// AddTorrent registers a completed torrent stored at path; The path follows the layout of DownloadFile.
+func (s *Seeder) AddTorrent(info MetaInfo, path string) error {
+	files := outputFiles(info, path)
+	for _, f := range files {
+		stat, err := os.Stat(filepath.Join(f.Path...))
+		if err != nil {
+			return fmt.Errorf("failed to stat file: %v", err)
+		}
+		if stat.Size() != int64(f.Length) {
+			return fmt.Errorf("file %s is incomplete: expected %d bytes, got %d", filepath.Join(f.Path...), f.Length, stat.Size())
+		}
+	}
+
+	storage, err := NewFileStorage(info, path, false)
+	if err != nil {
+		return err
+	}
+	for i := range info.Pieces {
+		storage.MarkComplete(i)
+	}
+
+	s.addTorrent(&seededTorrent{info: info, storage: storage, ownStorage: true})
+	return nil
+}
+
+// AddStorage registers a torrent whose pieces are in the storage; Only the completed pieces are served.
+// The storage stays open when the Seeder is closed.
+func (s *Seeder) AddStorage(info MetaInfo, storage Storage) {
+	s.addTorrent(&seededTorrent{info: info, storage: storage})
+}
+
+// addTorrent registers the torrent, replacing a previous one with the same info hash.
+func (s *Seeder) addTorrent(torrent *seededTorrent) {
+	s.mu.Lock()
+	previous := s.torrents[string(torrent.info.InfoHash)]
+	s.torrents[string(torrent.info.InfoHash)] = torrent
+	s.mu.Unlock()
+
+	if previous != nil && previous.ownStorage {
+		previous.storage.Close()
+	}
+}
+
+// Close stops serving and announcing, unregisters the torrents and closes the storages opened by AddTorrent.
+func (s *Seeder) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+
+	s.mu.Lock()
+	torrents := s.torrents
+	s.torrents = make(map[string]*seededTorrent)
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, t := range torrents {
+		if !t.ownStorage {
+			continue
+		}
+		err := t.storage.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// torrent returns the seeded torrent with the info hash, or nil if we don't hold it.
+func (s *Seeder) torrent(infoHash []byte) *seededTorrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.torrents[string(infoHash)]
+}
+
+// Announce tells the trackers of every seeded torrent that we are seeding on our port. It returns
+// when to announce again, which is the shortest interval the trackers asked for.
+func (s *Seeder) Announce() time.Duration {
+	s.mu.Lock()
+	torrents := make([]*seededTorrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	s.mu.Unlock()
+
+	next := seedAnnounceInterval
+	for _, t := range torrents {
+		resp, err := trackersFor(t.info.InfoHash, t.info.TrackerTiers()).Announce(AnnounceRequest{
+			InfoHash: t.info.InfoHash,
+			PeerID:   s.peerID,
+			Port:     s.port,
+			Left:     0,
+		})
+		if err != nil {
+			log.Printf("Failed to announce %x: %v", t.info.InfoHash, err)
+			continue
+		}
+		if resp.Interval > 0 {
+			next = min(next, max(resp.Interval, seedMinAnnounceInterval))
+		}
+	}
+	return next
+}
+
+// ListenAndServe listens on the port of the Seeder, announces the torrents periodically and serves incoming peers.
+func (s *Seeder) ListenAndServe() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	log.Printf("Seeding on %s", listener.Addr())
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			timer := time.NewTimer(s.Announce())
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+
+	return s.Serve(listener)
+}
+
+// Serve accepts incoming peer connections on the listener and serves them, up to maxSeedConnections at
+// the same time. It returns nil once the Seeder is closed.
+func (s *Seeder) Serve(listener net.Listener) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.closed:
+			listener.Close()
+		case <-done:
+		}
+	}()
+	go s.rechokeLoop(done)
+
+	slots := make(chan struct{}, maxSeedConnections)
+	for {
+		conn, err := listener.Accept()
+		select {
+		case <-s.closed:
+			if err == nil {
+				conn.Close()
+			}
+			return nil
+		default:
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %v", err)
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			log.Printf("Closing connection from peer %s: already %d peers connected", conn.RemoteAddr(), maxSeedConnections)
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer func() { <-slots }()
+			defer conn.Close()
+			err := s.handleConn(conn)
+			if err != nil {
+				log.Printf("Connection with peer %s closed: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// acceptHandshake reads the handshake of an incoming peer and replies if we hold the torrent.
+func (s *Seeder) acceptHandshake(conn net.Conn) (*seededTorrent, PeerHandshake, error) {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return nil, PeerHandshake{}, err
+	}
+
+	handshake, err := readHandshake(conn)
+	if err != nil {
+		return nil, PeerHandshake{}, err
+	}
+
+	torrent := s.torrent(handshake.InfoHash)
+	if torrent == nil {
+		return nil, PeerHandshake{}, fmt.Errorf("unknown info hash: %x", handshake.InfoHash)
+	}
+
+	// The seeder doesn't speak the extension protocol
+	_, err = conn.Write(newHandshakeMessage(reservedBytes(false), handshake.InfoHash, s.peerID))
+	if err != nil {
+		return nil, PeerHandshake{}, fmt.Errorf("failed to send handshake message: %v", err)
+	}
+
+	// readMessages and send set their own deadlines from now on
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, PeerHandshake{}, err
+	}
+	return torrent, handshake, nil
+}
+
+// requestUnchoke gives the peer an upload slot if one is free; Otherwise the peer waits for one, and
+// reports false.
+func (s *Seeder) requestUnchoke(c *seedConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unchoked[c] {
+		return true
+	}
+	if len(s.unchoked) < maxUnchokedPeers {
+		s.unchoked[c] = true
+		return true
+	}
+	for _, waiting := range s.waiting {
+		if waiting == c {
+			return false
+		}
+	}
+	s.waiting = append(s.waiting, c)
+	return false
+}
+
+// releaseUnchoke frees the upload slot of the peer, or stops it waiting for one. It returns the
+// waiting peer which gets the slot, if any.
+func (s *Seeder) releaseUnchoke(c *seedConn) *seedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, waiting := range s.waiting {
+		if waiting == c {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			break
+		}
+	}
+	if !s.unchoked[c] {
+		return nil
+	}
+	delete(s.unchoked, c)
+	if s.optimistic == c {
+		s.optimistic = nil
+	}
+
+	if len(s.waiting) == 0 {
+		return nil
+	}
+	next := s.waiting[0]
+	s.waiting = s.waiting[1:]
+	s.unchoked[next] = true
+	return next
+}
+
+// unchokeNext releases the upload slot of the peer and unchokes the peer waiting for it.
+func (s *Seeder) unchokeNext(c *seedConn) {
+	next := s.releaseUnchoke(c)
+	if next == nil {
+		return
+	}
+	err := next.unchoke()
+	if err != nil {
+		log.Printf("Failed to unchoke peer %s: %v", next.conn.RemoteAddr(), err)
+		next.close()
+	}
+}
+
+// rechokeLoop rechokes the peers every seedRechokeInterval until done is closed.
+func (s *Seeder) rechokeLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(seedRechokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		s.rechoke()
+	}
+}
+
+// rechoke gives the regular upload slots to the interested peers we uploaded the most to since the last
+// rechoke, and the optimistic unchoke to the peer waiting the longest every seedOptimisticRechokes rechokes.
+// The choked peers wait for a slot again.
+func (s *Seeder) rechoke() {
+	s.mu.Lock()
+	peers := make([]*seedConn, 0, len(s.unchoked)+len(s.waiting))
+	for c := range s.unchoked {
+		peers = append(peers, c)
+	}
+	peers = append(peers, s.waiting...)
+	uploaded := make(map[*seedConn]int64, len(peers))
+	for _, c := range peers {
+		uploaded[c] = c.takeUploaded()
+	}
+
+	rotate := s.optimistic == nil || s.rechokes%seedOptimisticRechokes == 0
+	s.rechokes++
+	if rotate {
+		s.optimistic = nil
+	}
+
+	// The waiting peers keep their order, behind the unchoked peers
+	sort.SliceStable(peers, func(i, j int) bool { return uploaded[peers[i]] > uploaded[peers[j]] })
+	unchoked := make(map[*seedConn]bool)
+	regular := 0
+	for _, c := range peers {
+		if regular >= maxUnchokedPeers-1 {
+			break
+		}
+		if c != s.optimistic {
+			unchoked[c] = true
+			regular++
+		}
+	}
+	if s.optimistic != nil {
+		unchoked[s.optimistic] = true
+	} else {
+		for _, c := range s.waiting {
+			if !unchoked[c] {
+				s.optimistic = c
+				unchoked[c] = true
+				break
+			}
+		}
+	}
+	// Fill the slots left when fewer peers are interested than there are slots
+	for _, c := range peers {
+		if len(unchoked) >= maxUnchokedPeers {
+			break
+		}
+		unchoked[c] = true
+	}
+
+	toUnchoke := make([]*seedConn, 0)
+	toChoke := make([]*seedConn, 0)
+	waiting := make([]*seedConn, 0, len(s.waiting))
+	for _, c := range s.waiting {
+		if unchoked[c] {
+			toUnchoke = append(toUnchoke, c)
+		} else {
+			waiting = append(waiting, c)
+		}
+	}
+	for c := range s.unchoked {
+		if !unchoked[c] {
+			toChoke = append(toChoke, c)
+			waiting = append(waiting, c)
+		}
+	}
+	s.unchoked = unchoked
+	s.waiting = waiting
+	s.mu.Unlock()
+
+	for _, c := range toChoke {
+		err := c.choke()
+		if err != nil {
+			log.Printf("Failed to choke peer %s: %v", c.conn.RemoteAddr(), err)
+			c.close()
+		}
+	}
+	for _, c := range toUnchoke {
+		err := c.unchoke()
+		if err != nil {
+			log.Printf("Failed to unchoke peer %s: %v", c.conn.RemoteAddr(), err)
+			c.close()
+		}
+	}
+}
+
+// seedConn is the state of a connection with a peer downloading from us.
+type seedConn struct {
+	seeder  *Seeder
+	conn    net.Conn
+	torrent *seededTorrent
+	// fast is true if both sides support the Fast Extension
+	fast bool
+	// allowedFast are the pieces the peer may request while it is choked
+	allowedFast map[int]bool
+
+	// writeMu serializes the messages written to the connection
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	unchoked bool
+	// uploaded is the number of bytes sent to the peer since the last rechoke
+	uploaded  int64
+	pending   []blockRequest
+	newWork   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// handleConn does the handshake, sends our bitfield and serves the requests of the peer.
+func (s *Seeder) handleConn(conn net.Conn) error {
+	torrent, handshake, err := s.acceptHandshake(conn)
+	if err != nil {
+		return err
+	}
+
+	c := &seedConn{
+		seeder:  s,
+		conn:    conn,
+		torrent: torrent,
+		fast:    handshake.Fast,
+		newWork: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	defer c.close()
+
+	err = c.send(c.bitfield())
+	if err != nil {
+		return fmt.Errorf("failed to send bitfield: %v", err)
+	}
+	err = c.sendAllowedFast()
+	if err != nil {
+		return err
+	}
+	err = sendDHTPort(conn, handshake)
+	if err != nil {
+		return err
+	}
+
+	go c.serveRequests()
+
+	return c.readMessages()
+}
+
+// bitfield returns the bitfield message of the completed pieces of the torrent.
+// With the Fast Extension, it is have all or have none when we have all or none of the pieces.
+func (c *seedConn) bitfield() PeerMessage {
+	have := make([]bool, len(c.torrent.info.Pieces))
+	completed := 0
+	for i := range have {
+		have[i] = c.torrent.storage.Completed(i)
+		if have[i] {
+			completed++
+		}
+	}
+
+	switch {
+	case c.fast && completed == len(have):
+		return newMessage(MsgHaveAll, nil)
+	case c.fast && completed == 0:
+		return newMessage(MsgHaveNone, nil)
+	default:
+		return newBitfieldMessage(have)
+	}
+}
+
+// sendAllowedFast tells a peer with the Fast Extension which of our pieces it may request while choked.
+func (c *seedConn) sendAllowedFast() error {
+	addr, ok := c.conn.RemoteAddr().(*net.TCPAddr)
+	if !c.fast || !ok {
+		return nil
+	}
+
+	c.allowedFast = make(map[int]bool)
+	for _, index := range allowedFastSet(addr.IP, c.torrent.info.InfoHash, len(c.torrent.info.Pieces), allowedFastSetSize) {
+		if !c.torrent.storage.Completed(index) {
+			continue
+		}
+		c.allowedFast[index] = true
+		err := c.send(newIndexMessage(MsgAllowedFast, index))
+		if err != nil {
+			return fmt.Errorf("failed to send allowed fast message: %v", err)
+		}
+	}
+	return nil
+}
+
+// allowedFastSet returns the k pieces a peer at the IP may download while choked, as computed in BEP 6;
+// It only depends on the /24 network of the peer, so reconnecting from another address doesn't give more pieces.
+// Peers without an IPv4 address get no pieces.
+func allowedFastSet(ip net.IP, infoHash []byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+
+	x := binary.BigEndian.AppendUint32(nil, binary.BigEndian.Uint32(ip4)&0xFFFFFF00)
+	x = append(x, infoHash...)
+	set := make([]int, 0, k)
+	seen := make(map[int]bool)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+func (c *seedConn) send(msg PeerMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	err := c.conn.SetWriteDeadline(time.Now().Add(seedWriteTimeout))
+	if err != nil {
+		return err
+	}
+	return sendPeerMessage(c.conn, msg)
+}
+
+// close closes the connection and passes its upload slot to the next waiting peer.
+func (c *seedConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+		c.seeder.unchokeNext(c)
+	})
+}
+
+// takeUploaded returns the number of bytes sent to the peer since the last call.
+func (c *seedConn) takeUploaded() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uploaded := c.uploaded
+	c.uploaded = 0
+	return uploaded
+}
+
+// unchoke lets the peer send requests; With the Fast Extension, we suggest the pieces served last.
+func (c *seedConn) unchoke() error {
+	c.mu.Lock()
+	alreadyUnchoked := c.unchoked
+	c.unchoked = true
+	c.mu.Unlock()
+
+	if alreadyUnchoked {
+		return nil
+	}
+	err := c.send(newMessage(MsgUnchoke, nil))
+	if err != nil {
+		return fmt.Errorf("failed to send unchoke message: %v", err)
+	}
+
+	if !c.fast {
+		return nil
+	}
+	for _, index := range c.torrent.suggestedPieces() {
+		err = c.send(newIndexMessage(MsgSuggestPiece, index))
+		if err != nil {
+			return fmt.Errorf("failed to send suggest piece message: %v", err)
+		}
+	}
+	return nil
+}
+
+// choke stops serving the peer and drops its pending requests, except the ones of allowed fast pieces.
+func (c *seedConn) choke() error {
+	c.mu.Lock()
+	wasUnchoked := c.unchoked
+	c.unchoked = false
+	kept := make([]blockRequest, 0)
+	dropped := make([]blockRequest, 0)
+	for _, req := range c.pending {
+		if c.allowedFast[req.Index] {
+			kept = append(kept, req)
+		} else {
+			dropped = append(dropped, req)
+		}
+	}
+	c.pending = kept
+	c.mu.Unlock()
+
+	// Without the Fast Extension, the choke implicitly drops the requests
+	err := c.reject(dropped...)
+	if err != nil {
+		return err
+	}
+	if !wasUnchoked {
+		return nil
+	}
+	err = c.send(newMessage(MsgChoke, nil))
+	if err != nil {
+		return fmt.Errorf("failed to send choke message: %v", err)
+	}
+	return nil
+}
+
+// readMessages handles the messages from the peer until the connection is closed; A peer silent
+// for longer than peerReadTimeout is disconnected.
+func (c *seedConn) readMessages() error {
+	for {
+		err := c.conn.SetReadDeadline(time.Now().Add(peerReadTimeout))
+		if err != nil {
+			return err
+		}
+		msg, err := recievePeerMessage(c.conn)
+		if err != nil {
+			return err
+		}
+
+		switch msg.ID {
+		case MsgInterested:
+			if c.seeder.requestUnchoke(c) {
+				err = c.unchoke()
+				if err != nil {
+					return err
+				}
+			}
+
+		case MsgNotInterested:
+			// The upload slot goes to a peer which wants it
+			err = c.choke()
+			if err != nil {
+				return err
+			}
+			c.seeder.unchokeNext(c)
+
+		case MsgRequest:
+			req, err := c.parseBlockRequest(msg)
+			if err != nil {
+				return err
+			}
+			c.mu.Lock()
+			// Requests of choked peers, except for allowed fast pieces, and for pieces we don't have, are rejected
+			serve := (c.unchoked || c.allowedFast[req.Index]) && c.torrent.storage.Completed(req.Index)
+			full := len(c.pending) >= maxPendingRequests
+			if serve && !full {
+				c.pending = append(c.pending, req)
+			}
+			c.mu.Unlock()
+
+			if serve && full {
+				if !c.fast {
+					return fmt.Errorf("peer queued more than %d requests", maxPendingRequests)
+				}
+				serve = false
+			}
+			if !serve {
+				err = c.reject(req)
+				if err != nil {
+					return err
+				}
+			}
+
+			select {
+			case c.newWork <- struct{}{}:
+			default:
+			}
+
+		case MsgCancel:
+			req, err := c.parseBlockRequest(msg)
+			if err != nil {
+				return err
+			}
+			c.mu.Lock()
+			cancelled := false
+			for i, pending := range c.pending {
+				if pending == req {
+					c.pending = append(c.pending[:i], c.pending[i+1:]...)
+					cancelled = true
+					break
+				}
+			}
+			c.mu.Unlock()
+
+			// With the Fast Extension, every request gets a piece or a reject
+			if cancelled {
+				err = c.reject(req)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// reject tells the peer we won't serve the requests, if the Fast Extension is enabled; Without it, they are dropped silently.
+func (c *seedConn) reject(reqs ...blockRequest) error {
+	if !c.fast {
+		return nil
+	}
+	for _, req := range reqs {
+		err := c.send(newBlockMessage(MsgRejectRequest, req))
+		if err != nil {
+			return fmt.Errorf("failed to send reject request message: %v", err)
+		}
+	}
+	return nil
+}
+
+// parseBlockRequest parses and validates a request or cancel message.
+func (c *seedConn) parseBlockRequest(msg PeerMessage) (blockRequest, error) {
+	req, err := parseBlockMessage(msg)
+	if err != nil {
+		return blockRequest{}, err
+	}
+
+	info := c.torrent.info
+	if req.Index >= len(info.Pieces) {
+		return blockRequest{}, fmt.Errorf("requested piece %d out of range", req.Index)
+	}
+	if req.Length <= 0 || req.Length > maxBlockRequestLength || req.Begin+req.Length > pieceSize(info, req.Index) {
+		return blockRequest{}, fmt.Errorf("invalid block request: %+v", req)
+	}
+
+	return req, nil
+}
+
+// serveRequests sends the requested blocks to the peer in the order they were requested, and keep-alives
+// while there is nothing to send.
+func (c *seedConn) serveRequests() {
+	keepAlive := time.NewTicker(seedKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-keepAlive.C:
+			err := c.send(PeerMessage{Length: 0, ID: MsgKeepAlive})
+			if err != nil {
+				log.Printf("Failed to send keep-alive to peer %s: %v", c.conn.RemoteAddr(), err)
+				c.close()
+				return
+			}
+			continue
+		case <-c.newWork:
+		}
+
+		for {
+			c.mu.Lock()
+			if len(c.pending) == 0 {
+				c.mu.Unlock()
+				break
+			}
+			req := c.pending[0]
+			c.pending = c.pending[1:]
+			c.mu.Unlock()
+
+			err := c.sendBlock(req)
+			if err != nil {
+				log.Printf("Failed to send block to peer %s: %v", c.conn.RemoteAddr(), err)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// sendBlock reads the requested block from the storage and sends it in a piece message.
+func (c *seedConn) sendBlock(req blockRequest) error {
+	block := make([]byte, req.Length)
+	_, err := c.torrent.storage.ReadAt(req.Index, block, req.Begin)
+	if err != nil {
+		return err
+	}
+	c.torrent.servedPiece(req.Index)
+
+	err = c.send(newPieceMessage(req.Index, req.Begin, block))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.uploaded += int64(req.Length)
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestSeedConn returns a connection of an interested peer, whose messages are discarded.
+func newTestSeedConn(t *testing.T, s *Seeder) *seedConn {
+	t.Helper()
+	local, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	c := &seedConn{
+		seeder:  s,
+		conn:    local,
+		torrent: &seededTorrent{},
+		newWork: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	if s.requestUnchoke(c) {
+		err := c.unchoke()
+		if err != nil {
+			t.Fatalf("unchoke: %v", err)
+		}
+	}
+	return c
+}
+
+func TestSeederRechoke(t *testing.T) {
+	s := NewSeeder(0)
+	peers := make([]*seedConn, 8)
+	for i := range peers {
+		peers[i] = newTestSeedConn(t, s)
+	}
+	isUnchoked := func(c *seedConn) bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.unchoked
+	}
+
+	// The first peers got the slots; The fastest ones keep the regular slots, and the peer waiting the
+	// longest gets the optimistic unchoke
+	peers[1].uploaded = 300
+	peers[2].uploaded = 200
+	peers[6].uploaded = 100
+	s.rechoke()
+	want := map[*seedConn]bool{peers[1]: true, peers[2]: true, peers[6]: true, peers[4]: true}
+	for i, c := range peers {
+		if isUnchoked(c) != want[c] || s.unchoked[c] != want[c] {
+			t.Errorf("after the first rechoke, peer %d unchoked = %v, want %v", i, isUnchoked(c), want[c])
+		}
+	}
+	if s.optimistic != peers[4] {
+		t.Errorf("optimistic unchoke is not the peer waiting the longest")
+	}
+
+	// The optimistic unchoke is kept until it rotates to the next waiting peer
+	for i := 1; i < seedOptimisticRechokes; i++ {
+		s.rechoke()
+		if s.optimistic != peers[4] || !isUnchoked(peers[4]) {
+			t.Fatalf("optimistic unchoke changed after %d rechokes", i+1)
+		}
+	}
+	s.rechoke()
+	if s.optimistic == peers[4] || s.optimistic == nil || !isUnchoked(s.optimistic) {
+		t.Errorf("optimistic unchoke didn't rotate after %d rechokes", seedOptimisticRechokes)
+	}
+	if len(s.unchoked) != maxUnchokedPeers || len(s.waiting) != len(peers)-maxUnchokedPeers {
+		t.Errorf("%d peers unchoked and %d waiting, want %d and %d", len(s.unchoked), len(s.waiting), maxUnchokedPeers, len(peers)-maxUnchokedPeers)
+	}
+}
+
+func TestSeederCloseStopsServe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := NewSeeder(0)
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(listener) }()
+
+	s.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve after Close: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve still running after Close")
+	}
+}
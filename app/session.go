@@ -0,0 +1,752 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// maxPeerSessions is the maximum number of peers we download from at the same time.
+const maxPeerSessions = 10
+
+// pieceResult is a verified piece downloaded by a peer session.
+type pieceResult struct {
+	index int
+	data  []byte
+}
+
+// swarm holds the state of a torrent download shared by all the peer sessions.
+// Every session pulls pieces from the shared work queue, and puts them back if it fails to download them.
+type swarm struct {
+	info MetaInfo
+	// pipelineDepth is the number of block requests kept in flight with each peer
+	pipelineDepth int
+	work          chan int
+	results       chan pieceResult
+	done          chan struct{}
+	// idle is signaled whenever a session ends
+	idle   chan struct{}
+	banned *peerBanList
+
+	mu      sync.Mutex
+	known   map[string]bool
+	backlog []string
+	active  int
+	// connected are the peers with a session past the handshake, which we tell other peers about with PEX,
+	// and their connections, which close closes
+	connected map[string]net.Conn
+	closed    bool
+}
+
+// newSwarm returns a swarm with the given pieces queued for download.
+func newSwarm(info MetaInfo, pieces []int, opts DownloadOptions) *swarm {
+	s := &swarm{
+		info:          info,
+		pipelineDepth: opts.pipelineDepth(),
+		// The queue can hold every piece, so putting a piece back never blocks
+		work:      make(chan int, len(pieces)),
+		results:   make(chan pieceResult, len(pieces)),
+		done:      make(chan struct{}),
+		idle:      make(chan struct{}, 1),
+		banned:    newPeerBanList(),
+		known:     make(map[string]bool),
+		connected: make(map[string]net.Conn),
+	}
+	for _, i := range pieces {
+		s.work <- i
+	}
+	return s
+}
+
+// AddPeers adds peers to the candidates of the swarm, and starts sessions with them if there is room.
+func (s *swarm) AddPeers(peers []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, peer := range peers {
+		if s.known[peer] {
+			continue
+		}
+		s.known[peer] = true
+		s.backlog = append(s.backlog, peer)
+	}
+	s.startSessions()
+}
+
+// startSessions starts sessions with the candidates until the limit is reached; s.mu must be held.
+func (s *swarm) startSessions() {
+	for !s.closed && s.active < maxPeerSessions && len(s.backlog) > 0 {
+		peer := s.backlog[0]
+		s.backlog = s.backlog[1:]
+		if s.banned.IsBanned(peer) {
+			continue
+		}
+
+		s.active++
+		go func() {
+			err := s.runSession(peer)
+			if err != nil && !s.isClosed() {
+				log.Printf("Session with peer %s ended: %v", peer, err)
+			}
+			s.sessionEnded()
+		}()
+	}
+}
+
+// sessionEnded starts a session with the next candidate, and signals that a session ended.
+func (s *swarm) sessionEnded() {
+	s.mu.Lock()
+	s.active--
+	s.startSessions()
+	s.mu.Unlock()
+
+	select {
+	case s.idle <- struct{}{}:
+	default:
+	}
+}
+
+// addConnected records the session with the peer; It reports false if the swarm is already closed.
+func (s *swarm) addConnected(peer string, conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.connected[peer] = conn
+	return true
+}
+
+// removeConnected forgets the session with the peer.
+func (s *swarm) removeConnected(peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.connected, peer)
+}
+
+// connectedPeers returns the peers we have a session with, except the given one.
+func (s *swarm) connectedPeers(except string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]string, 0, len(s.connected))
+	for peer := range s.connected {
+		if peer != except {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// exhausted reports whether there is no running session and no candidate left to try.
+func (s *swarm) exhausted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active == 0 && len(s.backlog) == 0
+}
+
+// close stops all the sessions of the swarm; Their connections are closed, so sessions blocked
+// reading from their peer return right away.
+func (s *swarm) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	for _, conn := range s.connected {
+		conn.Close()
+	}
+}
+
+// isClosed reports whether close was called.
+func (s *swarm) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Peer session timeouts.
+const (
+	// peerReadTimeout is how long we wait for a message; Peers send keep-alives every two minutes.
+	peerReadTimeout = 3 * time.Minute
+	// peerStallTimeout is how long we wait for a peer to get one of the remaining pieces, or to allow us to
+	// download more of them while choked.
+	peerStallTimeout = 2 * time.Minute
+)
+
+// peerUnchokeTimeout is how long a peer may keep us choked before we drop it, so it doesn't hold a session slot
+// with keep-alives alone.
+var peerUnchokeTimeout = time.Minute
+
+// peerSession is a long-lived connection with a peer, and the state of the connection.
+// Every message read from the peer goes through handleMessage, which keeps the state up to date.
+type peerSession struct {
+	peer string
+	conn net.Conn
+	info MetaInfo
+
+	// Pieces the peer has, from its bitfield and have messages
+	bitfield []byte
+	// peerChoking is true while the peer doesn't serve our requests
+	peerChoking    bool
+	peerInterested bool
+	amInterested   bool
+	// dhtPort is the DHT port the peer sent in a port message, if any
+	dhtPort int
+	// receivedMessages counts the messages from the peer; A bitfield is only valid as the first one
+	receivedMessages int
+
+	// fast is true if both sides support the Fast Extension
+	fast bool
+	// allowedFast are the pieces the peer serves even while it chokes us
+	allowedFast map[int]bool
+	// rejected are the pieces the peer refused to serve while we were allowed to request them
+	rejected map[int]bool
+
+	// extensions maps the extensions of the peer to their message IDs, from its extension handshake
+	extensions map[string]int
+	// pex tracks the peers we told the peer about
+	pex pexState
+	// learnedPeers are the peers the peer told us about with PEX, until the swarm takes them
+	learnedPeers []string
+}
+
+// dialPeerSession connects to the peer, does the handshake and tells the peer we are interested.
+func dialPeerSession(peer string, info MetaInfo) (*peerSession, error) {
+	conn, err := net.DialTimeout("tcp", peer, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %v", err)
+	}
+
+	handshake, err := HandshakePeer(conn, info.InfoHash)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed: %v", err)
+	}
+
+	session := newPeerSession(peer, conn, info)
+	session.fast = handshake.Fast
+
+	err = sendHaveNone(conn, handshake)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = sendDHTPort(conn, handshake)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The extension handshake of the peer arrives with the other messages, and is handled by handleMessage
+	if handshake.Extensions {
+		err = sendExtensionHandshake(conn, map[string]int{"ut_pex": utPexID})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	err = session.sendInterested()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// sendHaveNone tells a peer with the Fast Extension that we have no pieces, since it expects have all, have none
+// or a bitfield right after the handshake; We don't upload on outgoing connections.
+func sendHaveNone(conn net.Conn, handshake PeerHandshake) error {
+	if !handshake.Fast {
+		return nil
+	}
+	err := sendPeerMessage(conn, newMessage(MsgHaveNone, nil))
+	if err != nil {
+		return fmt.Errorf("failed to send have none message: %v", err)
+	}
+	return nil
+}
+
+// newPeerSession returns the session of a connection which completed the handshake.
+func newPeerSession(peer string, conn net.Conn, info MetaInfo) *peerSession {
+	return &peerSession{
+		peer:        peer,
+		conn:        conn,
+		info:        info,
+		bitfield:    make([]byte, (len(info.Pieces)+7)/8),
+		peerChoking: true,
+		allowedFast: make(map[int]bool),
+		rejected:    make(map[int]bool),
+	}
+}
+
+// hasPiece reports whether the peer announced the piece in its bitfield or a have message.
+func (p *peerSession) hasPiece(index int) bool {
+	return hasBit(p.bitfield, index)
+}
+
+// canDownload reports whether we can request the piece from the peer now.
+func (p *peerSession) canDownload(index int) bool {
+	return p.hasPiece(index) && !p.rejected[index] && (!p.peerChoking || p.allowedFast[index])
+}
+
+// hasAllowedFast reports whether the peer has pieces we can download while it chokes us.
+func (p *peerSession) hasAllowedFast() bool {
+	for index := range p.allowedFast {
+		if p.hasPiece(index) && !p.rejected[index] {
+			return true
+		}
+	}
+	return false
+}
+
+// sendInterested tells the peer we want to download from it.
+func (p *peerSession) sendInterested() error {
+	err := sendInterestedMessage(p.conn)
+	if err != nil {
+		return fmt.Errorf("failed to send interested message: %v", err)
+	}
+	p.amInterested = true
+	return nil
+}
+
+// readMessage reads the next message from the peer and updates the state of the session.
+func (p *peerSession) readMessage() (PeerMessage, error) {
+	return p.readMessageUntil(time.Now().Add(peerReadTimeout))
+}
+
+// errPeerDeadline is returned by readMessageUntil when no message arrives before the deadline.
+var errPeerDeadline = errors.New("no message from the peer before the deadline")
+
+// readMessageUntil is readMessage, but fails with errPeerDeadline if no message arrives before the deadline.
+func (p *peerSession) readMessageUntil(deadline time.Time) (PeerMessage, error) {
+	err := p.conn.SetReadDeadline(deadline)
+	if err != nil {
+		return PeerMessage{}, err
+	}
+
+	msg, err := recievePeerMessage(p.conn)
+	if err != nil && !time.Now().Before(deadline) {
+		return PeerMessage{}, errPeerDeadline
+	}
+	if err != nil {
+		return PeerMessage{}, err
+	}
+
+	err = p.handleMessage(msg)
+	if err != nil {
+		return PeerMessage{}, err
+	}
+	return msg, nil
+}
+
+// handleMessage updates the state of the session from a message of the peer.
+// Messages which need a response from the caller, like piece, are returned as is by readMessage.
+func (p *peerSession) handleMessage(msg PeerMessage) error {
+	if msg.ID == MsgKeepAlive {
+		return nil
+	}
+	// The extension handshake may come before the bitfield, so extension messages aren't counted
+	if msg.ID != MsgExtended {
+		p.receivedMessages++
+	}
+
+	switch msg.ID {
+	case MsgChoke:
+		p.peerChoking = true
+	case MsgUnchoke:
+		p.peerChoking = false
+	case MsgInterested:
+		p.peerInterested = true
+	case MsgNotInterested:
+		p.peerInterested = false
+	case MsgHave:
+		index, err := parseIndexMessage(msg)
+		if err != nil {
+			return err
+		}
+		setBit(p.bitfield, index)
+	case MsgBitfield:
+		if p.receivedMessages != 1 {
+			return fmt.Errorf("bitfield must be the first message")
+		}
+		if len(msg.Payload) != len(p.bitfield) {
+			return fmt.Errorf("invalid bitfield length: expected %d, got %d", len(p.bitfield), len(msg.Payload))
+		}
+		copy(p.bitfield, msg.Payload)
+	case MsgHaveAll, MsgHaveNone:
+		if !p.fast {
+			return fmt.Errorf("%s message without the fast extension", msg.ID)
+		}
+		if p.receivedMessages != 1 {
+			return fmt.Errorf("%s must be the first message", msg.ID)
+		}
+		if msg.ID == MsgHaveAll {
+			for i := range p.info.Pieces {
+				setBit(p.bitfield, i)
+			}
+		}
+	case MsgSuggestPiece, MsgAllowedFast:
+		if !p.fast {
+			return fmt.Errorf("%s message without the fast extension", msg.ID)
+		}
+		index, err := parseIndexMessage(msg)
+		if err != nil {
+			return err
+		}
+		// Suggestions are only advice; We take pieces in the order of the work queue.
+		// Allowed fast pieces out of range are ignored, as the peer may not know the torrent size yet.
+		if msg.ID == MsgAllowedFast && index < len(p.info.Pieces) {
+			p.allowedFast[index] = true
+		}
+	case MsgRejectRequest:
+		if !p.fast {
+			return fmt.Errorf("%s message without the fast extension", msg.ID)
+		}
+		_, err := parseBlockMessage(msg)
+		if err != nil {
+			return err
+		}
+	case MsgRequest, MsgCancel:
+		// We don't serve pieces on download sessions; The Seeder does
+		_, err := parseBlockMessage(msg)
+		if err != nil {
+			return err
+		}
+	case MsgPiece:
+		_, _, _, err := parsePieceMessage(msg)
+		if err != nil {
+			return err
+		}
+	case MsgPort:
+		port, err := parsePortMessage(msg)
+		if err != nil {
+			return err
+		}
+		p.dhtPort = port
+	case MsgExtended:
+		p.handleExtensionMessage(msg)
+	default:
+		// Unknown messages, including extensions we didn't negotiate, are ignored
+	}
+
+	return nil
+}
+
+// handleExtensionMessage handles the extension handshake and the ut_pex messages of the peer.
+// Invalid extension messages are logged and ignored; The peer may still serve pieces.
+func (p *peerSession) handleExtensionMessage(msg PeerMessage) {
+	if len(msg.Payload) < 1 {
+		log.Printf("Ignoring empty extension message from peer %s", p.peer)
+		return
+	}
+
+	switch msg.Payload[0] {
+	case extensionHandshakeID:
+		handshake, err := parseExtensionHandshake(msg.Payload[1:])
+		if err != nil {
+			log.Printf("Ignoring extension handshake from peer %s: %v", p.peer, err)
+			return
+		}
+		p.extensions = handshake.Extensions
+	case utPexID:
+		peers, err := parsePexMessage(msg.Payload[1:])
+		if err != nil {
+			log.Printf("Ignoring pex message from peer %s: %v", p.peer, err)
+			return
+		}
+		p.learnedPeers = append(p.learnedPeers, peers...)
+	}
+}
+
+// takeLearnedPeers returns the peers learned with PEX since the last call.
+func (p *peerSession) takeLearnedPeers() []string {
+	peers := p.learnedPeers
+	p.learnedPeers = nil
+	return peers
+}
+
+// sendPex tells the peer about the connected peers which changed since the last PEX message,
+// if the peer supports ut_pex and the last message is old enough.
+func (p *peerSession) sendPex(connected []string) error {
+	id, ok := p.extensions["ut_pex"]
+	if !ok {
+		return nil
+	}
+	msg, ok := p.pex.next(connected)
+	if !ok {
+		return nil
+	}
+
+	payload, err := bencode.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	err = sendExtensionMessage(p.conn, id, payload)
+	if err != nil {
+		return fmt.Errorf("failed to send pex message: %v", err)
+	}
+	return nil
+}
+
+// waitForUnchoke reads messages from the peer until it unchokes us, or allows us to download one of its pieces while choked.
+// It fails if that doesn't happen within peerUnchokeTimeout.
+func (p *peerSession) waitForUnchoke() error {
+	deadline := time.Now().Add(peerUnchokeTimeout)
+	for p.peerChoking && !p.hasAllowedFast() {
+		_, err := p.readMessageUntil(deadline)
+		if errors.Is(err, errPeerDeadline) {
+			return fmt.Errorf("peer did not unchoke us in %v", peerUnchokeTimeout)
+		}
+		if err != nil {
+			return fmt.Errorf("failed while waiting for unchoke: %v", err)
+		}
+	}
+	return nil
+}
+
+// errPieceRejected is returned by downloadPiece when the peer rejects a request for the piece.
+var errPieceRejected = errors.New("peer rejected the request")
+
+// downloadPiece downloads a piece from the peer, keeping up to `depth` block requests in flight.
+// If the peer chokes us, the requests in flight are dropped and sent again once it unchokes us.
+// With the Fast Extension, the peer rejects the requests it won't serve instead, and the download
+// stops with errPieceRejected.
+func (p *peerSession) downloadPiece(index, depth int) ([]byte, error) {
+	totalPieceLen := pieceSize(p.info, index)
+	log.Printf("Downloading piece %d - Total Piece Length: %d\n", index, totalPieceLen)
+
+	buffer := make([]byte, totalPieceLen)
+	numBlocks := (totalPieceLen + PieceLength - 1) / PieceLength
+	received := make([]bool, numBlocks)
+	requested := make([]bool, numBlocks)
+	depth = max(depth, 1)
+
+	inFlight := 0
+	done := 0
+	for done < numBlocks {
+		// Fill the pipeline; While choked, only allowed fast pieces can be requested
+		canRequest := !p.peerChoking || p.allowedFast[index]
+		for block := 0; block < numBlocks && inFlight < depth && canRequest; block++ {
+			if received[block] || requested[block] {
+				continue
+			}
+			begin := block * PieceLength
+			err := sendRequestMessage(p.conn, index, begin, min(PieceLength, totalPieceLen-begin))
+			if err != nil {
+				return nil, fmt.Errorf("failed to send request message: %v", err)
+			}
+			requested[block] = true
+			inFlight++
+		}
+
+		msg, err := p.readMessage()
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive piece message: %v", err)
+		}
+
+		switch msg.ID {
+		case MsgChoke:
+			// Without the Fast Extension, the peer discards our pending requests when it chokes us
+			if !p.fast {
+				for block := range requested {
+					requested[block] = false
+				}
+				inFlight = 0
+			}
+			continue
+		case MsgRejectRequest:
+			// Rejects of requests we already dropped are ignored
+			req, _ := parseBlockMessage(msg)
+			blockNum := req.Begin / PieceLength
+			if req.Index != index || req.Begin%PieceLength != 0 || blockNum >= numBlocks || !requested[blockNum] || received[blockNum] {
+				continue
+			}
+			// Unless the reject comes with a choke, the peer won't serve the piece at all
+			if !p.peerChoking || p.allowedFast[index] {
+				p.rejected[index] = true
+			}
+			requested[blockNum] = false
+			return nil, p.cancelRequests(index, requested, received)
+		case MsgPiece:
+		default:
+			continue
+		}
+
+		// Blocks may arrive in any order; Match them by their index and begin.
+		// Blocks we didn't ask for, like late answers to dropped requests, are ignored.
+		blockIndex, begin, block, _ := parsePieceMessage(msg)
+		if blockIndex != index || begin%PieceLength != 0 || begin >= totalPieceLen {
+			continue
+		}
+		blockNum := begin / PieceLength
+		if received[blockNum] {
+			continue
+		}
+
+		downloadLen := min(PieceLength, totalPieceLen-begin)
+		if len(block) != downloadLen {
+			return nil, fmt.Errorf("unexpected block size: expected %d, got %d", downloadLen, len(block))
+		}
+
+		copy(buffer[begin:begin+downloadLen], block)
+		received[blockNum] = true
+		if requested[blockNum] {
+			inFlight--
+		}
+		done++
+	}
+
+	return buffer, nil
+}
+
+// cancelRequests cancels the requests in flight for the piece after a reject, and returns errPieceRejected.
+func (p *peerSession) cancelRequests(index int, requested, received []bool) error {
+	totalPieceLen := pieceSize(p.info, index)
+	for block := range requested {
+		if !requested[block] || received[block] {
+			continue
+		}
+		begin := block * PieceLength
+		req := blockRequest{Index: index, Begin: begin, Length: min(PieceLength, totalPieceLen-begin)}
+		err := sendPeerMessage(p.conn, newBlockMessage(MsgCancel, req))
+		if err != nil {
+			return fmt.Errorf("failed to send cancel message: %v", err)
+		}
+	}
+	return errPieceRejected
+}
+
+// runSession downloads pieces from the peer until the work is done or the peer fails.
+func (s *swarm) runSession(peer string) error {
+	session, err := dialPeerSession(peer, s.info)
+	if err != nil {
+		return err
+	}
+	defer session.conn.Close()
+	log.Printf("Connected to peer %s", peer)
+
+	if !s.addConnected(peer, session.conn) {
+		return nil
+	}
+	defer s.removeConnected(peer)
+
+	// Number of pieces in a row the peer didn't have, and since when it has none of the queued pieces
+	skipped := 0
+	var stalledSince time.Time
+
+	for {
+		// Peer exchange happens between pieces
+		s.AddPeers(session.takeLearnedPeers())
+		err := session.sendPex(s.connectedPeers(peer))
+		if err != nil {
+			return err
+		}
+
+		err = session.waitForUnchoke()
+		if err != nil {
+			return err
+		}
+
+		var index int
+		select {
+		case <-s.done:
+			return nil
+		case index = <-s.work:
+		}
+
+		if !session.canDownload(index) {
+			s.work <- index
+			skipped++
+			if skipped < len(s.work) {
+				continue
+			}
+
+			// Every queued piece was skipped; Wait for the peer to get one of them, to unchoke us, or to
+			// allow more pieces while choked
+			if stalledSince.IsZero() {
+				stalledSince = time.Now()
+			}
+			_, err = session.readMessageUntil(stalledSince.Add(peerStallTimeout))
+			if errors.Is(err, errPeerDeadline) {
+				return fmt.Errorf("peer has none of the remaining pieces")
+			}
+			if err != nil {
+				return fmt.Errorf("failed while waiting for pieces: %v", err)
+			}
+			skipped = 0
+			continue
+		}
+		skipped = 0
+		stalledSince = time.Time{}
+
+		piece, err := session.downloadPiece(index, s.pipelineDepth)
+		if errors.Is(err, errPieceRejected) {
+			// Put the piece back right away, for another peer or for when the peer unchokes us
+			s.work <- index
+			continue
+		}
+		if err != nil {
+			s.work <- index
+			return fmt.Errorf("failed to download piece %d: %v", index, err)
+		}
+
+		// Throw away the piece if it is corrupt; The piece will be requested from another peer
+		err = verifyPiece(s.info, index, piece)
+		if err != nil {
+			s.work <- index
+			s.banned.Ban(peer)
+			return fmt.Errorf("banned: %v", err)
+		}
+
+		log.Printf("Successfully downloaded piece %d from peer %s", index, peer)
+		s.results <- pieceResult{index: index, data: piece}
+	}
+}
+
+// downloadPieces downloads the pieces from the peers of the torrent, announcing to the trackers once.
+// handle is called for every verified piece, from a single goroutine.
+func downloadPieces(info MetaInfo, pieces []int, opts DownloadOptions, handle func(index int, data []byte) error) error {
+	peers, err := GetPeers(info)
+	if err != nil {
+		return fmt.Errorf("failed to get peers: %v", err)
+	}
+	if len(peers) == 0 {
+		return fmt.Errorf("failed to get peers: no peers found")
+	}
+
+	s := newSwarm(info, pieces, opts)
+	defer s.close()
+	s.AddPeers(peers)
+
+	// Sources like LSD may discover more peers during the download
+	stop := watchPeers(info.InfoHash, s.AddPeers)
+	defer stop()
+
+	remaining := len(pieces)
+	for remaining > 0 {
+		select {
+		case result := <-s.results:
+			err := handle(result.index, result.data)
+			if err != nil {
+				return err
+			}
+			remaining--
+		case <-s.idle:
+		}
+
+		if remaining > 0 && len(s.results) == 0 && s.exhausted() {
+			return fmt.Errorf("no peers left, %d pieces not downloaded", remaining)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage stores the pieces of a torrent.
+// Offsets are relative to the start of the piece; Implementations must be safe for concurrent use.
+type Storage interface {
+	// ReadAt reads len(b) bytes of the piece starting at begin.
+	ReadAt(index int, b []byte, begin int) (int, error)
+	// WriteAt writes b into the piece starting at begin.
+	WriteAt(index int, b []byte, begin int) (int, error)
+	// MarkComplete records that the piece is fully written and verified.
+	MarkComplete(index int)
+	// Completed reports whether the piece was marked complete.
+	Completed(index int) bool
+	Close() error
+}
+
+// readPiece reads a whole piece from the storage.
+func readPiece(storage Storage, info MetaInfo, index int) ([]byte, error) {
+	data := make([]byte, pieceSize(info, index))
+	_, err := storage.ReadAt(index, data, 0)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// writePiece writes a whole verified piece to the storage and marks it complete.
+func writePiece(storage Storage, index int, data []byte) error {
+	_, err := storage.WriteAt(index, data, 0)
+	if err != nil {
+		return err
+	}
+	storage.MarkComplete(index)
+	return nil
+}
+
+// syncStorage flushes the storage to its backing medium, if it supports it.
+func syncStorage(storage Storage) error {
+	if s, ok := storage.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// pieceCompletion keeps track of the completed pieces; It is embedded by the Storage implementations.
+type pieceCompletion struct {
+	mu        sync.Mutex
+	completed []bool
+}
+
+func newPieceCompletion(numPieces int) pieceCompletion {
+	return pieceCompletion{completed: make([]bool, numPieces)}
+}
+
+// MarkComplete records that the piece is fully written and verified.
+func (c *pieceCompletion) MarkComplete(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index >= 0 && index < len(c.completed) {
+		c.completed[index] = true
+	}
+}
+
+// Completed reports whether the piece was marked complete.
+func (c *pieceCompletion) Completed(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return index >= 0 && index < len(c.completed) && c.completed[index]
+}
+
+// torrentOffset checks that the range is inside the piece and returns its offset in the torrent data.
+func torrentOffset(info MetaInfo, index, begin, length int) (int, error) {
+	if index < 0 || index >= len(info.Pieces) {
+		return 0, fmt.Errorf("piece index %d out of range", index)
+	}
+	if begin < 0 || begin+length > pieceSize(info, index) {
+		return 0, fmt.Errorf("range %d+%d out of piece %d", begin, length, index)
+	}
+	return index*info.PieceLength + begin, nil
+}
+
+// FileStorage stores the pieces of a torrent directly in its output files, at their offsets.
+// The files are allocated to their final size up front; On most filesystems they stay sparse until written.
+type FileStorage struct {
+	pieceCompletion
+	info  MetaInfo
+	files []FileInfo
+
+	handlesMu sync.Mutex
+	handles   map[string]*os.File
+}
+
+// NewFileStorage opens the output files of the torrent at path, creating and allocating them if needed.
+// With truncate, existing data is thrown away; Otherwise it is kept so a download can be resumed.
+func NewFileStorage(info MetaInfo, path string, truncate bool) (*FileStorage, error) {
+	s := &FileStorage{
+		pieceCompletion: newPieceCompletion(len(info.Pieces)),
+		info:            info,
+		files:           outputFiles(info, path),
+		handles:         make(map[string]*os.File),
+	}
+
+	for _, f := range s.files {
+		file, err := openOutputFile(filepath.Join(f.Path...), f.Length, truncate)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles[file.Name()] = file
+	}
+
+	return s, nil
+}
+
+// openOutputFile opens an output file for reading and writing, and resizes it to its length if needed.
+func openOutputFile(filePath string, length int, truncate bool) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(filePath, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	// Only resize when needed; Truncating updates the modification time used by fast-resume
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat file: %v", err)
+	}
+	if stat.Size() != int64(length) {
+		err = file.Truncate(int64(length))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to allocate file: %v", err)
+		}
+	}
+
+	return file, nil
+}
+
+// ReadAt reads len(b) bytes of the piece starting at begin, from the files the range belongs to.
+func (s *FileStorage) ReadAt(index int, b []byte, begin int) (int, error) {
+	offset, err := torrentOffset(s.info, index, begin, len(b))
+	if err != nil {
+		return 0, err
+	}
+
+	s.handlesMu.Lock()
+	defer s.handlesMu.Unlock()
+
+	for _, segment := range pieceSegments(s.files, offset, len(b)) {
+		_, err := s.handles[segment.Path].ReadAt(b[segment.PieceOffset:segment.PieceOffset+segment.Length], int64(segment.FileOffset))
+		if err != nil {
+			return 0, fmt.Errorf("failed to read piece %d: %v", index, err)
+		}
+	}
+	return len(b), nil
+}
+
+// WriteAt writes b into the piece starting at begin, across the files the range belongs to.
+func (s *FileStorage) WriteAt(index int, b []byte, begin int) (int, error) {
+	offset, err := torrentOffset(s.info, index, begin, len(b))
+	if err != nil {
+		return 0, err
+	}
+
+	s.handlesMu.Lock()
+	defer s.handlesMu.Unlock()
+
+	for _, segment := range pieceSegments(s.files, offset, len(b)) {
+		_, err := s.handles[segment.Path].WriteAt(b[segment.PieceOffset:segment.PieceOffset+segment.Length], int64(segment.FileOffset))
+		if err != nil {
+			return 0, fmt.Errorf("failed to write piece %d: %v", index, err)
+		}
+	}
+	return len(b), nil
+}
+
+// Sync flushes the written pieces to disk.
+func (s *FileStorage) Sync() error {
+	s.handlesMu.Lock()
+	defer s.handlesMu.Unlock()
+
+	for _, file := range s.handles {
+		err := file.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync file: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close closes all the output files.
+func (s *FileStorage) Close() error {
+	s.handlesMu.Lock()
+	defer s.handlesMu.Unlock()
+
+	var firstErr error
+	for _, file := range s.handles {
+		err := file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.handles = make(map[string]*os.File)
+	return firstErr
+}
+
+// MemoryStorage keeps the whole torrent data in memory; Useful for tests and for embedding the library.
+type MemoryStorage struct {
+	pieceCompletion
+	info MetaInfo
+
+	dataMu sync.RWMutex
+	data   []byte
+}
+
+// NewMemoryStorage returns an empty MemoryStorage for the torrent.
+func NewMemoryStorage(info MetaInfo) *MemoryStorage {
+	return &MemoryStorage{
+		pieceCompletion: newPieceCompletion(len(info.Pieces)),
+		info:            info,
+		data:            make([]byte, info.Length),
+	}
+}
+
+// ReadAt reads len(b) bytes of the piece starting at begin.
+func (s *MemoryStorage) ReadAt(index int, b []byte, begin int) (int, error) {
+	offset, err := torrentOffset(s.info, index, begin, len(b))
+	if err != nil {
+		return 0, err
+	}
+
+	s.dataMu.RLock()
+	defer s.dataMu.RUnlock()
+	return copy(b, s.data[offset:offset+len(b)]), nil
+}
+
+// WriteAt writes b into the piece starting at begin.
+func (s *MemoryStorage) WriteAt(index int, b []byte, begin int) (int, error) {
+	offset, err := torrentOffset(s.info, index, begin, len(b))
+	if err != nil {
+		return 0, err
+	}
+
+	s.dataMu.Lock()
+	defer s.dataMu.Unlock()
+	return copy(s.data[offset:offset+len(b)], b), nil
+}
+
+// Bytes returns the torrent data; The slice must not be modified while the storage is in use.
+func (s *MemoryStorage) Bytes() []byte {
+	s.dataMu.RLock()
+	defer s.dataMu.RUnlock()
+	return s.data
+}
+
+// Close does nothing; The data stays available through Bytes.
+func (s *MemoryStorage) Close() error {
+	return nil
+}
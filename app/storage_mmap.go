@@ -0,0 +1,151 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// MmapStorage stores the pieces of a torrent in its output files, which are mapped in memory.
+type MmapStorage struct {
+	pieceCompletion
+	info  MetaInfo
+	files []FileInfo
+
+	mu      sync.RWMutex
+	handles []*os.File
+	// mappings holds the mapped memory of each output file; Empty files are not mapped
+	mappings map[string][]byte
+}
+
+// NewMmapStorage opens the output files of the torrent at path like NewFileStorage, and maps them in memory.
+func NewMmapStorage(info MetaInfo, path string, truncate bool) (*MmapStorage, error) {
+	s := &MmapStorage{
+		pieceCompletion: newPieceCompletion(len(info.Pieces)),
+		info:            info,
+		files:           outputFiles(info, path),
+		mappings:        make(map[string][]byte),
+	}
+
+	for _, f := range s.files {
+		filePath := filepath.Join(f.Path...)
+		file, err := openOutputFile(filePath, f.Length, truncate)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles = append(s.handles, file)
+
+		if f.Length == 0 {
+			continue
+		}
+		mapping, err := syscall.Mmap(int(file.Fd()), 0, f.Length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to map file: %v", err)
+		}
+		s.mappings[filePath] = mapping
+	}
+
+	return s, nil
+}
+
+// ReadAt reads len(b) bytes of the piece starting at begin, from the mapped files.
+func (s *MmapStorage) ReadAt(index int, b []byte, begin int) (int, error) {
+	offset, err := torrentOffset(s.info, index, begin, len(b))
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, segment := range pieceSegments(s.files, offset, len(b)) {
+		mapping, ok := s.mappings[segment.Path]
+		if !ok {
+			return 0, fmt.Errorf("storage is closed")
+		}
+		copy(b[segment.PieceOffset:segment.PieceOffset+segment.Length], mapping[segment.FileOffset:])
+	}
+	return len(b), nil
+}
+
+// WriteAt writes b into the piece starting at begin, into the mapped files.
+func (s *MmapStorage) WriteAt(index int, b []byte, begin int) (int, error) {
+	offset, err := torrentOffset(s.info, index, begin, len(b))
+	if err != nil {
+		return 0, err
+	}
+
+	// Writers only touch their own ranges of the mappings, so the read lock is enough
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, segment := range pieceSegments(s.files, offset, len(b)) {
+		mapping, ok := s.mappings[segment.Path]
+		if !ok {
+			return 0, fmt.Errorf("storage is closed")
+		}
+		copy(mapping[segment.FileOffset:segment.FileOffset+segment.Length], b[segment.PieceOffset:segment.PieceOffset+segment.Length])
+	}
+	return len(b), nil
+}
+
+// Sync flushes the mapped files to disk; The mappings are synced first, since without a unified
+// buffer cache, like on the BSDs, their dirty pages don't reach the file before msync.
+func (s *MmapStorage) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, mapping := range s.mappings {
+		err := msync(mapping)
+		if err != nil {
+			return fmt.Errorf("failed to sync mapping: %v", err)
+		}
+	}
+	for _, file := range s.handles {
+		err := file.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync file: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close unmaps and closes all the output files.
+func (s *MmapStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, mapping := range s.mappings {
+		err := syscall.Munmap(mapping)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, file := range s.handles {
+		err := file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.mappings = make(map[string][]byte)
+	s.handles = nil
+	return firstErr
+}
+
+// msync writes the dirty pages of the mapping to its file and waits for the writes to complete.
+// The syscall package has no wrapper for it.
+func msync(mapping []byte) error {
+	_, _, errno := syscall.Syscall(sysMsync, uintptr(unsafe.Pointer(&mapping[0])), uintptr(len(mapping)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,4 @@
+package app
+
+// sysMsync is the number of the msync system call, __msync13 on NetBSD; The syscall package doesn't define it.
+const sysMsync = 277
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package app
+
+import "fmt"
+
+// MmapStorage is not supported on this platform.
+type MmapStorage struct {
+	FileStorage
+}
+
+// NewMmapStorage is not supported on this platform; Use NewFileStorage instead.
+func NewMmapStorage(info MetaInfo, path string, truncate bool) (*MmapStorage, error) {
+	return nil, fmt.Errorf("mmap storage is not supported on this platform")
+}
@@ -2,21 +2,117 @@ package app
 
 import (
 	"crypto/sha1"
+	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
 )
 
 // MetaInfo holds all metadata related information for the given torrent.
 type MetaInfo struct {
-	TrackerUrl  string
+	TrackerUrl string
+	// AnnounceList holds the tiers of trackers from `announce-list` (BEP 12)
+	AnnounceList [][]string
+	Name         string
+	Length       int
+	InfoHash     []byte
+	PieceLength  int
+	Pieces       []string
+	// Files is only set for multi-file torrents; Length is then the sum of all the file lengths.
+	Files []FileInfo
+}
+
+// FileInfo describes a single file of a multi-file torrent.
+type FileInfo struct {
+	// Path components relative to the torrent directory
+	Path   []string
+	Length int
+	// Offset of the file in the concatenated data of the torrent
+	Offset int
+}
+
+// TrackerTiers returns the tracker tiers to announce to; `announce-list` takes precedence over `announce`.
+func (info MetaInfo) TrackerTiers() [][]string {
+	if len(info.AnnounceList) > 0 {
+		return info.AnnounceList
+	}
+	if info.TrackerUrl == "" {
+		return nil
+	}
+	return [][]string{{info.TrackerUrl}}
+}
+
+// IsMultiFile reports whether the torrent contains a list of files instead of a single file.
+func (info MetaInfo) IsMultiFile() bool {
+	return len(info.Files) > 0
+}
+
+// fileSegment is the part of a piece which belongs to a single file on disk.
+type fileSegment struct {
+	Path string
+	// Offset inside the file
+	FileOffset int
+	// Offset inside the piece
+	PieceOffset int
 	Length      int
-	InfoHash    []byte
-	PieceLength int
-	Pieces      []string
+}
+
+// outputFiles returns the files on disk for the torrent, with their offsets in the torrent data.
+// A single-file torrent is saved to the path itself, a multi-file torrent is saved inside a
+// directory named after the torrent under the path.
+func outputFiles(info MetaInfo, path string) []FileInfo {
+	if !info.IsMultiFile() {
+		return []FileInfo{{Path: []string{path}, Length: info.Length, Offset: 0}}
+	}
+
+	files := make([]FileInfo, 0, len(info.Files))
+	for _, f := range info.Files {
+		components := append([]string{path, info.Name}, f.Path...)
+		files = append(files, FileInfo{Path: []string{filepath.Join(components...)}, Length: f.Length, Offset: f.Offset})
+	}
+	return files
+}
+
+// pieceSegments maps the bytes of a piece onto the files it crosses.
+func pieceSegments(files []FileInfo, pieceOffset, pieceLen int) []fileSegment {
+	segments := make([]fileSegment, 0)
+	pieceEnd := pieceOffset + pieceLen
+
+	for _, f := range files {
+		fileEnd := f.Offset + f.Length
+		// Empty files hold no bytes of any piece
+		if f.Length == 0 || fileEnd <= pieceOffset || f.Offset >= pieceEnd {
+			continue
+		}
+
+		start := max(f.Offset, pieceOffset)
+		end := min(fileEnd, pieceEnd)
+		segments = append(segments, fileSegment{
+			Path:        filepath.Join(f.Path...),
+			FileOffset:  start - f.Offset,
+			PieceOffset: start - pieceOffset,
+			Length:      end - start,
+		})
+	}
+
+	return segments
+}
+
+// pieceSize returns the actual size of the piece; The last piece may be shorter than the piece length.
+func pieceSize(info MetaInfo, index int) int {
+	return min(info.PieceLength, info.Length-index*info.PieceLength)
 }
 
 // CalculateInfoHash calculates the SHA1 hash of the Bencoded value of `info` dictionary from torrent file.
-func CalculateInfoHash(infoDict BNode) []byte {
-	encodedInfo := EncodeBNode(infoDict)
+// A decoded dictionary is hashed from its original bytes; Only dictionaries built in code, like the ones
+// of CreateTorrent, are encoded again.
+func CalculateInfoHash(infoDict bencode.BNode) []byte {
+	encodedInfo := []byte(infoDict.Raw)
+	if infoDict.Raw == "" {
+		encodedInfo = bencode.EncodeBNode(infoDict)
+	}
 	h := sha1.New()
 	h.Write([]byte(encodedInfo))
 	encodedInfo = h.Sum(nil)
@@ -24,33 +120,201 @@ func CalculateInfoHash(infoDict BNode) []byte {
 	return encodedInfo
 }
 
+// torrentFile is the bencoded content of a torrent file.
+type torrentFile struct {
+	Announce string `bencode:"announce"`
+	// AnnounceList is parsed by hand, since malformed tiers are skipped instead of failing the torrent
+	AnnounceList bencode.BNode `bencode:"announce-list"`
+	// Info keeps the original bytes of the info dictionary for the info hash
+	Info bencode.RawMessage `bencode:"info"`
+}
+
+// infoDict is the bencoded `info` dictionary of a torrent; Pointers tell missing keys apart.
+type infoDict struct {
+	Name        string      `bencode:"name"`
+	PieceLength *int        `bencode:"piece length"`
+	Pieces      *string     `bencode:"pieces"`
+	Length      *int        `bencode:"length"`
+	Files       *[]fileDict `bencode:"files"`
+}
+
+// fileDict is an entry of the `files` list of a multi-file torrent.
+type fileDict struct {
+	Length *int     `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
 // ParseTorrentFile parses a torrent file to a MetaInfo object.
 func ParseTorrentFile(filePath string) (MetaInfo, error) {
-	file, err := os.ReadFile(filePath)
+	file, err := os.Open(filePath)
 	if err != nil {
 		return MetaInfo{}, err
 	}
+	defer file.Close()
 
-	decodedTorrent, _, err := DecodeBencodeDict(string(file))
+	// Some torrent files have unsorted keys; The info hash is still right since it is computed from the original bytes
+	decoder := bencode.NewDecoder(file)
+	decoder.AllowUnsortedKeys()
+
+	var torrent torrentFile
+	err = decoder.Decode(&torrent)
+	if err != nil {
+		return MetaInfo{}, fmt.Errorf("invalid torrent file: %v", err)
+	}
+	if len(torrent.Info) == 0 {
+		return MetaInfo{}, fmt.Errorf("torrent file has no info dictionary")
+	}
+
+	result, err := ParseInfoDict(torrent.Info)
 	if err != nil {
 		return MetaInfo{}, err
 	}
-	info := decodedTorrent.Dict["info"]
+	result.TrackerUrl = torrent.Announce
+	if torrent.AnnounceList.Raw != "" {
+		result.AnnounceList = parseAnnounceList(torrent.AnnounceList)
+	}
+
+	return result, nil
+}
+
+// ParseInfoDict parses the bencoded `info` dictionary of a torrent to a MetaInfo object without the tracker URL.
+// The info hash is the hash of the given bytes.
+func ParseInfoDict(data []byte) (MetaInfo, error) {
+	var info infoDict
+	err := bencode.UnmarshalLenient(data, &info)
+	if err != nil {
+		return MetaInfo{}, fmt.Errorf("invalid info dictionary: %v", err)
+	}
+
+	if info.Pieces == nil || len(*info.Pieces)%20 != 0 {
+		return MetaInfo{}, fmt.Errorf("invalid pieces in info dictionary")
+	}
+	if info.PieceLength == nil || *info.PieceLength <= 0 {
+		return MetaInfo{}, fmt.Errorf("invalid piece length in info dictionary")
+	}
 
 	// Separate each piece, Each piece is 20 bytes long
-	piecesStr := info.Dict["pieces"].Str
+	piecesStr := *info.Pieces
 	pieces := make([]string, 0)
 	for i := 0; i < len(piecesStr); i += 20 {
 		pieces = append(pieces, piecesStr[i:i+20])
 	}
 
+	infoHash := sha1.Sum(data)
 	result := MetaInfo{
-		TrackerUrl:  decodedTorrent.Dict["announce"].Str,
-		Length:      info.Dict["length"].Int,
-		InfoHash:    CalculateInfoHash(*info),
-		PieceLength: info.Dict["piece length"].Int,
+		Name:        info.Name,
+		InfoHash:    infoHash[:],
+		PieceLength: *info.PieceLength,
 		Pieces:      pieces,
 	}
 
+	if info.Files != nil {
+		result.Files, result.Length, err = parseFileList(*info.Files)
+		if err != nil {
+			return MetaInfo{}, err
+		}
+		if result.Name == "" || !isSafePathComponent(result.Name) {
+			return MetaInfo{}, fmt.Errorf("invalid torrent name: %q", result.Name)
+		}
+	} else if info.Length != nil {
+		if *info.Length < 0 {
+			return MetaInfo{}, fmt.Errorf("invalid length in info dictionary")
+		}
+		result.Length = *info.Length
+	} else {
+		return MetaInfo{}, fmt.Errorf("torrent info has neither length nor files")
+	}
+
+	err = checkPieceCount(result)
+	if err != nil {
+		return MetaInfo{}, err
+	}
+
 	return result, nil
 }
+
+// checkPieceCount checks that every piece has a hash, and every hash a piece; Otherwise the last piece
+// would be missing or have a negative size.
+func checkPieceCount(info MetaInfo) error {
+	if info.PieceLength <= 0 || info.Length < 0 {
+		return fmt.Errorf("invalid piece length %d or length %d", info.PieceLength, info.Length)
+	}
+	pieceCount := info.Length / info.PieceLength
+	if info.Length%info.PieceLength != 0 {
+		pieceCount++
+	}
+	if len(info.Pieces) != pieceCount {
+		return fmt.Errorf("torrent has %d piece hashes, but %d bytes make %d pieces", len(info.Pieces), info.Length, pieceCount)
+	}
+	return nil
+}
+
+// parseAnnounceList parses the `announce-list` tiers, skipping malformed entries.
+func parseAnnounceList(node bencode.BNode) [][]string {
+	tiers := make([][]string, 0)
+	if node.Type != bencode.BList {
+		return tiers
+	}
+
+	for _, tierNode := range node.List {
+		if tierNode.Type != bencode.BList {
+			continue
+		}
+		tier := make([]string, 0, len(tierNode.List))
+		for _, trackerUrl := range tierNode.List {
+			if trackerUrl.Type == bencode.BString && trackerUrl.Str != "" {
+				tier = append(tier, trackerUrl.Str)
+			}
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+
+	return tiers
+}
+
+// parseFileList checks the `files` list of a multi-file torrent and returns the files with the total length.
+func parseFileList(list []fileDict) ([]FileInfo, int, error) {
+	if len(list) == 0 {
+		return nil, 0, fmt.Errorf("invalid files list")
+	}
+
+	files := make([]FileInfo, 0, len(list))
+	offset := 0
+	for _, item := range list {
+		if item.Length == nil || *item.Length < 0 {
+			return nil, 0, fmt.Errorf("invalid file length")
+		}
+		length := *item.Length
+		if length > math.MaxInt-offset {
+			return nil, 0, fmt.Errorf("total length of the files is too large")
+		}
+		if len(item.Path) == 0 {
+			return nil, 0, fmt.Errorf("invalid file path")
+		}
+		for _, component := range item.Path {
+			if !isSafePathComponent(component) {
+				return nil, 0, fmt.Errorf("invalid file path component: %q", component)
+			}
+		}
+
+		files = append(files, FileInfo{Path: item.Path, Length: length, Offset: offset})
+		offset += length
+	}
+
+	return files, offset, nil
+}
+
+// isSafePathComponent reports whether a path component can't escape the torrent directory.
+func isSafePathComponent(component string) bool {
+	if component == "" || component == "." || component == ".." {
+		return false
+	}
+	for i := 0; i < len(component); i++ {
+		if component[i] == '/' || component[i] == '\\' || component[i] == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,243 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
+)
+
+// DefaultPort is the port we announce to the trackers.
+const DefaultPort = 6881
+
+// trackerHTTPClient sends the announces to HTTP trackers; A tracker which doesn't answer must not block the download.
+var trackerHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// AnnounceRequest holds the parameters sent to a tracker on announce.
+type AnnounceRequest struct {
+	InfoHash   []byte
+	PeerID     string
+	Port       int
+	Uploaded   int
+	Downloaded int
+	Left       int
+}
+
+// AnnounceResponse holds the peers returned by a tracker.
+type AnnounceResponse struct {
+	Peers []string
+	// Interval is how long the tracker wants us to wait before announcing again; Zero if it didn't say
+	Interval time.Duration
+}
+
+// Tracker announces our presence for a torrent and returns the peers it knows about.
+type Tracker interface {
+	Announce(req AnnounceRequest) (AnnounceResponse, error)
+}
+
+// NewTracker returns the tracker client for the URL based on its scheme.
+func NewTracker(trackerUrl string) (Tracker, error) {
+	u, err := url.Parse(trackerUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL: %v", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return httpTracker{url: trackerUrl}, nil
+	case "udp":
+		return udpTracker{host: u.Host}, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %s", u.Scheme)
+	}
+}
+
+// httpTracker is a tracker using the HTTP(S) protocol.
+type httpTracker struct {
+	url string
+}
+
+// trackerResponse is the bencoded response of an HTTP tracker.
+type trackerResponse struct {
+	FailureReason string `bencode:"failure reason"`
+	Interval      int    `bencode:"interval"`
+	// Peers is a compact string, or a list of dictionaries
+	Peers bencode.RawMessage `bencode:"peers"`
+}
+
+// trackerPeer is a peer of the dictionary list of a tracker response.
+type trackerPeer struct {
+	IP   string `bencode:"ip"`
+	Port int    `bencode:"port"`
+}
+
+// Announce sends the announce request to the tracker and returns the list of peers.
+func (t httpTracker) Announce(req AnnounceRequest) (AnnounceResponse, error) {
+	params := url.Values{}
+	params.Add("info_hash", string(req.InfoHash))
+	params.Add("peer_id", req.PeerID)
+	params.Add("port", fmt.Sprintf("%d", req.Port))
+	params.Add("uploaded", fmt.Sprintf("%d", req.Uploaded))
+	params.Add("downloaded", fmt.Sprintf("%d", req.Downloaded))
+	params.Add("left", fmt.Sprintf("%d", req.Left))
+	params.Add("compact", "1")
+
+	fullUrl := t.url + "?" + params.Encode()
+
+	resp, err := trackerHTTPClient.Get(fullUrl)
+	if err != nil {
+		return AnnounceResponse{}, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Many trackers send dictionaries with unsorted keys
+	decoder := bencode.NewDecoder(resp.Body)
+	decoder.AllowUnsortedKeys()
+
+	var decoded trackerResponse
+	err = decoder.Decode(&decoded)
+	if err != nil {
+		return AnnounceResponse{}, fmt.Errorf("failed to decode response body: %v", err)
+	}
+	if decoded.FailureReason != "" {
+		return AnnounceResponse{}, fmt.Errorf("tracker error: %s", decoded.FailureReason)
+	}
+	if len(decoded.Peers) == 0 {
+		return AnnounceResponse{}, fmt.Errorf("tracker response has no peers")
+	}
+
+	result := AnnounceResponse{}
+	if decoded.Interval > 0 {
+		result.Interval = time.Duration(decoded.Interval) * time.Second
+	}
+
+	// Trackers may ignore `compact` and send a list of dictionaries instead
+	if decoded.Peers[0] == 'l' {
+		var peers []trackerPeer
+		err = bencode.UnmarshalLenient(decoded.Peers, &peers)
+		if err != nil {
+			return AnnounceResponse{}, fmt.Errorf("invalid peers in tracker response: %v", err)
+		}
+		result.Peers = make([]string, 0, len(peers))
+		for _, peer := range peers {
+			if peer.IP == "" || peer.Port == 0 {
+				continue
+			}
+			result.Peers = append(result.Peers, fmt.Sprintf("%s:%d", peer.IP, peer.Port))
+		}
+		return result, nil
+	}
+
+	var compact string
+	err = bencode.UnmarshalLenient(decoded.Peers, &compact)
+	if err != nil {
+		return AnnounceResponse{}, fmt.Errorf("invalid peers in tracker response: %v", err)
+	}
+	result.Peers = parseCompactPeers(compact)
+	return result, nil
+}
+
+// TrackerTiers announces to a list of tracker tiers as described in BEP 12.
+// Trackers are tried tier by tier; The first tracker which responds is moved to the front of its tier.
+type TrackerTiers struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+// NewTrackerTiers shuffles the trackers inside each tier and returns the TrackerTiers.
+func NewTrackerTiers(tiers [][]string) *TrackerTiers {
+	result := &TrackerTiers{tiers: make([][]string, 0, len(tiers))}
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+		shuffled := append([]string(nil), tier...)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		result.tiers = append(result.tiers, shuffled)
+	}
+	return result
+}
+
+// Announce tries the trackers in order until one of them responds.
+func (t *TrackerTiers) Announce(req AnnounceRequest) (AnnounceResponse, error) {
+	// Work on a snapshot, so concurrent announces don't wait for each other's network requests
+	t.mu.Lock()
+	tiers := make([][]string, len(t.tiers))
+	for i, tier := range t.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	t.mu.Unlock()
+
+	if len(tiers) == 0 {
+		return AnnounceResponse{}, fmt.Errorf("no trackers available")
+	}
+
+	var lastErr error
+	for tierIndex, tier := range tiers {
+		for _, trackerUrl := range tier {
+			tracker, err := NewTracker(trackerUrl)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			resp, err := tracker.Announce(req)
+			if err != nil {
+				log.Printf("Failed to announce to tracker %s: %v", trackerUrl, err)
+				lastErr = err
+				continue
+			}
+
+			t.promote(tierIndex, trackerUrl)
+			return resp, nil
+		}
+	}
+
+	return AnnounceResponse{}, fmt.Errorf("all trackers failed, last error: %v", lastErr)
+}
+
+// promote moves the tracker to the front of its tier.
+func (t *TrackerTiers) promote(tierIndex int, trackerUrl string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tier := t.tiers[tierIndex]
+	for i, u := range tier {
+		if u == trackerUrl {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = trackerUrl
+			return
+		}
+	}
+}
+
+// trackerRegistry keeps one TrackerTiers per torrent and tier list, so promoted trackers are remembered
+// between announces.
+var trackerRegistry = struct {
+	mu    sync.Mutex
+	tiers map[string]*TrackerTiers
+}{tiers: make(map[string]*TrackerTiers)}
+
+// trackersFor returns the TrackerTiers of the torrent, creating it from the tiers on first use.
+// Other tiers for the same torrent, like the trackers of a magnet link and then those of its
+// torrent file, get their own TrackerTiers.
+func trackersFor(infoHash []byte, tiers [][]string) *TrackerTiers {
+	key := fmt.Sprintf("%x %q", infoHash, tiers)
+
+	trackerRegistry.mu.Lock()
+	defer trackerRegistry.mu.Unlock()
+
+	t, ok := trackerRegistry.tiers[key]
+	if !ok {
+		t = NewTrackerTiers(tiers)
+		trackerRegistry.tiers[key] = t
+	}
+	return t
+}
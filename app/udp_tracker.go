@@ -0,0 +1,218 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15) constants.
+const (
+	udpProtocolID     = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionError    = 3
+	// udpConnectionIDTTL is how long a connection ID can be reused after the connect response.
+	udpConnectionIDTTL = time.Minute
+	// udpTrackerMaxRetries is the maximum `n` of the udpTrackerTimeout * 2^n retransmission timeout of BEP 15;
+	// BEP 15 allows 8, which blocks for hours before the next tracker of the tier is tried.
+	udpTrackerMaxRetries = 2
+)
+
+// udpTrackerTimeout is the base retransmission timeout for UDP tracker requests.
+var udpTrackerTimeout = 5 * time.Second
+
+// udpTrackerDeadline bounds a whole announce with its retries, like trackerHTTPClient for HTTP trackers.
+var udpTrackerDeadline = 15 * time.Second
+
+// udpConnection is a connection ID received from a UDP tracker.
+type udpConnection struct {
+	id      uint64
+	expires time.Time
+}
+
+// udpConnectionCache caches the connection IDs per tracker address, so they are reused until they expire.
+type udpConnectionCache struct {
+	mu  sync.Mutex
+	ids map[string]udpConnection
+}
+
+var udpConnections = &udpConnectionCache{ids: make(map[string]udpConnection)}
+
+func (c *udpConnectionCache) get(addr string) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, ok := c.ids[addr]
+	if !ok || time.Now().After(conn.expires) {
+		return 0, false
+	}
+	return conn.id, true
+}
+
+func (c *udpConnectionCache) set(addr string, id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids[addr] = udpConnection{id: id, expires: time.Now().Add(udpConnectionIDTTL)}
+}
+
+func (c *udpConnectionCache) invalidate(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.ids, addr)
+}
+
+// udpTracker is a tracker using the UDP tracker protocol.
+type udpTracker struct {
+	host string
+}
+
+// Announce does the connect/announce handshake with the tracker and returns the list of peers.
+func (t udpTracker) Announce(req AnnounceRequest) (AnnounceResponse, error) {
+	conn, err := net.Dial("udp", t.host)
+	if err != nil {
+		return AnnounceResponse{}, fmt.Errorf("failed to connect to tracker: %v", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(udpTrackerDeadline)
+	for n := 0; n <= udpTrackerMaxRetries; n++ {
+		timeout := min(udpTrackerTimeout*(1<<n), time.Until(deadline))
+		if timeout <= 0 {
+			break
+		}
+
+		connectionID, ok := udpConnections.get(t.host)
+		if !ok {
+			connectionID, err = udpConnect(conn, timeout)
+			if isTimeout(err) {
+				continue
+			}
+			if err != nil {
+				return AnnounceResponse{}, err
+			}
+			udpConnections.set(t.host, connectionID)
+		}
+
+		resp, err := udpAnnounce(conn, connectionID, req, timeout)
+		if isTimeout(err) {
+			// The connection ID may have expired on the tracker side; Get a new one on retry
+			udpConnections.invalidate(t.host)
+			continue
+		}
+		return resp, err
+	}
+
+	return AnnounceResponse{}, fmt.Errorf("tracker %s did not respond", t.host)
+}
+
+// udpConnect sends a connect request and returns the connection ID.
+func udpConnect(conn net.Conn, timeout time.Duration) (uint64, error) {
+	transactionID := newTransactionID()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(req[12:16], transactionID)
+
+	resp, err := udpRoundTrip(conn, req, udpActionConnect, transactionID, timeout)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 16 {
+		return 0, fmt.Errorf("connect response too short: %d bytes", len(resp))
+	}
+
+	return binary.BigEndian.Uint64(resp[8:16]), nil
+}
+
+// udpAnnounce sends an announce request and returns the list of peers.
+func udpAnnounce(conn net.Conn, connectionID uint64, req AnnounceRequest, timeout time.Duration) (AnnounceResponse, error) {
+	transactionID := newTransactionID()
+
+	packet := make([]byte, 98)
+	binary.BigEndian.PutUint64(packet[0:8], connectionID)
+	binary.BigEndian.PutUint32(packet[8:12], udpActionAnnounce)
+	binary.BigEndian.PutUint32(packet[12:16], transactionID)
+	copy(packet[16:36], req.InfoHash)
+	copy(packet[36:56], req.PeerID)
+	binary.BigEndian.PutUint64(packet[56:64], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(packet[64:72], uint64(req.Left))
+	binary.BigEndian.PutUint64(packet[72:80], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(packet[80:84], 0) // event: none
+	binary.BigEndian.PutUint32(packet[84:88], 0) // IP address: default
+	binary.BigEndian.PutUint32(packet[88:92], newTransactionID())
+	binary.BigEndian.PutUint32(packet[92:96], 0xFFFFFFFF) // num_want: default
+	binary.BigEndian.PutUint16(packet[96:98], uint16(req.Port))
+
+	resp, err := udpRoundTrip(conn, packet, udpActionAnnounce, transactionID, timeout)
+	if err != nil {
+		return AnnounceResponse{}, err
+	}
+	if len(resp) < 20 {
+		return AnnounceResponse{}, fmt.Errorf("announce response too short: %d bytes", len(resp))
+	}
+
+	// Skip action and transaction ID; The peers follow the interval, leechers and seeders
+	return AnnounceResponse{
+		Peers:    parseCompactPeers(string(resp[20:])),
+		Interval: time.Duration(binary.BigEndian.Uint32(resp[8:12])) * time.Second,
+	}, nil
+}
+
+// udpRoundTrip sends the request and waits for the response with the same transaction ID.
+// Responses of other transactions are ignored; A timeout error is returned as is so the caller can retry.
+func udpRoundTrip(conn net.Conn, req []byte, action, transactionID uint32, timeout time.Duration) ([]byte, error) {
+	_, err := conn.Write(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to tracker: %v", err)
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := buf[:n]
+
+		if len(resp) < 8 || binary.BigEndian.Uint32(resp[4:8]) != transactionID {
+			continue
+		}
+
+		gotAction := binary.BigEndian.Uint32(resp[0:4])
+		if gotAction == udpActionError {
+			return nil, fmt.Errorf("tracker error: %s", resp[8:])
+		}
+		if gotAction != action {
+			return nil, fmt.Errorf("unexpected tracker action: expected %d, got %d", action, gotAction)
+		}
+
+		return append([]byte(nil), resp...), nil
+	}
+}
+
+// newTransactionID returns a random 32-bit transaction ID.
+func newTransactionID() uint32 {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatalf("failed to generate transaction ID: %v", err)
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// isTimeout reports whether the error is a network timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
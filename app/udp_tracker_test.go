@@ -0,0 +1,299 @@
+package app
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubUDPTracker is a UDP tracker on loopback which answers connect and announce requests.
+type stubUDPTracker struct {
+	conn  *net.UDPConn
+	peers []byte
+
+	mu sync.Mutex
+	// connectionIDs are the connection IDs the tracker accepts; Announces with others are ignored
+	connectionIDs map[uint64]bool
+	nextID        uint64
+	connects      int
+	announces     int
+	// dropConnects is the number of connect requests to ignore, to make the client retry
+	dropConnects int
+	// wrongTransaction makes the tracker send a response with another transaction ID before each answer
+	wrongTransaction bool
+}
+
+func newStubUDPTracker(t *testing.T, peers []string) *stubUDPTracker {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	tracker := &stubUDPTracker{conn: conn, connectionIDs: make(map[uint64]bool), nextID: 0x1234}
+	for _, peer := range peers {
+		compact, ok := compactPeerAddr(peer)
+		if !ok {
+			t.Fatalf("invalid peer %q", peer)
+		}
+		tracker.peers = append(tracker.peers, compact...)
+	}
+	go tracker.serve()
+	return tracker
+}
+
+func (s *stubUDPTracker) host() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *stubUDPTracker) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+		action := binary.BigEndian.Uint32(buf[8:12])
+		transactionID := binary.BigEndian.Uint32(buf[12:16])
+
+		var resp []byte
+		s.mu.Lock()
+		switch {
+		case action == udpActionConnect && binary.BigEndian.Uint64(buf[0:8]) == udpProtocolID:
+			s.connects++
+			if s.dropConnects > 0 {
+				s.dropConnects--
+				break
+			}
+			s.nextID++
+			s.connectionIDs[s.nextID] = true
+			resp = make([]byte, 16)
+			binary.BigEndian.PutUint64(resp[8:16], s.nextID)
+		case action == udpActionAnnounce && n >= 98:
+			s.announces++
+			if !s.connectionIDs[binary.BigEndian.Uint64(buf[0:8])] {
+				break
+			}
+			resp = make([]byte, 20, 20+len(s.peers))
+			binary.BigEndian.PutUint32(resp[8:12], 1800)
+			resp = append(resp, s.peers...)
+		}
+		wrongTransaction := s.wrongTransaction
+		s.mu.Unlock()
+
+		if resp == nil {
+			continue
+		}
+		binary.BigEndian.PutUint32(resp[0:4], action)
+		if wrongTransaction {
+			// A stale response with garbage data the client must not use
+			stale := append([]byte(nil), resp[:8]...)
+			binary.BigEndian.PutUint32(stale[4:8], transactionID+1)
+			stale = append(stale, "garbage!"...)
+			s.conn.WriteToUDP(stale, addr)
+		}
+		binary.BigEndian.PutUint32(resp[4:8], transactionID)
+		s.conn.WriteToUDP(resp, addr)
+	}
+}
+
+// counts returns the number of connect and announce requests received.
+func (s *stubUDPTracker) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connects, s.announces
+}
+
+// expireConnections makes the tracker forget the connection IDs it gave out.
+func (s *stubUDPTracker) expireConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connectionIDs = make(map[uint64]bool)
+}
+
+func setUDPTrackerTimeout(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	old := udpTrackerTimeout
+	udpTrackerTimeout = timeout
+	t.Cleanup(func() { udpTrackerTimeout = old })
+}
+
+// newSilentUDPTracker returns the host of a UDP tracker on loopback which never answers.
+func newSilentUDPTracker(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func testAnnounceRequest() AnnounceRequest {
+	return AnnounceRequest{
+		InfoHash: []byte(strings.Repeat("i", 20)),
+		PeerID:   strings.Repeat("p", 20),
+		Port:     6881,
+		Left:     100,
+	}
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	setUDPTrackerTimeout(t, time.Second)
+	want := []string{"10.0.0.1:6881", "10.0.0.2:51413"}
+	stub := newStubUDPTracker(t, want)
+	tracker := udpTracker{host: stub.host()}
+
+	resp, err := tracker.Announce(testAnnounceRequest())
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if !reflect.DeepEqual(resp.Peers, want) {
+		t.Errorf("peers = %v, want %v", resp.Peers, want)
+	}
+	if resp.Interval != 30*time.Minute {
+		t.Errorf("interval = %v, want 30m", resp.Interval)
+	}
+
+	// The connection ID is cached, so the second announce doesn't connect again
+	_, err = tracker.Announce(testAnnounceRequest())
+	if err != nil {
+		t.Fatalf("second Announce: %v", err)
+	}
+	if connects, announces := stub.counts(); connects != 1 || announces != 2 {
+		t.Errorf("got %d connects and %d announces, want 1 and 2", connects, announces)
+	}
+}
+
+func TestUDPTrackerIgnoresOtherTransactions(t *testing.T) {
+	setUDPTrackerTimeout(t, time.Second)
+	want := []string{"10.0.0.1:6881"}
+	stub := newStubUDPTracker(t, want)
+	stub.mu.Lock()
+	stub.wrongTransaction = true
+	stub.mu.Unlock()
+
+	resp, err := udpTracker{host: stub.host()}.Announce(testAnnounceRequest())
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if !reflect.DeepEqual(resp.Peers, want) {
+		t.Errorf("peers = %v, want %v", resp.Peers, want)
+	}
+}
+
+func TestUDPTrackerConnectionIDExpiry(t *testing.T) {
+	setUDPTrackerTimeout(t, 100*time.Millisecond)
+	stub := newStubUDPTracker(t, []string{"10.0.0.1:6881"})
+	tracker := udpTracker{host: stub.host()}
+
+	_, err := tracker.Announce(testAnnounceRequest())
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+
+	// Expired on our side: the cached ID isn't used anymore
+	udpConnections.mu.Lock()
+	conn := udpConnections.ids[stub.host()]
+	conn.expires = time.Now().Add(-time.Second)
+	udpConnections.ids[stub.host()] = conn
+	udpConnections.mu.Unlock()
+
+	_, err = tracker.Announce(testAnnounceRequest())
+	if err != nil {
+		t.Fatalf("Announce after local expiry: %v", err)
+	}
+	if connects, _ := stub.counts(); connects != 2 {
+		t.Errorf("got %d connects after local expiry, want 2", connects)
+	}
+
+	// Expired on the tracker side: the announce times out, and the retry connects again
+	stub.expireConnections()
+	_, err = tracker.Announce(testAnnounceRequest())
+	if err != nil {
+		t.Fatalf("Announce after tracker expiry: %v", err)
+	}
+	if connects, announces := stub.counts(); connects != 3 || announces != 4 {
+		t.Errorf("got %d connects and %d announces after tracker expiry, want 3 and 4", connects, announces)
+	}
+}
+
+func TestUDPTrackerRetry(t *testing.T) {
+	setUDPTrackerTimeout(t, 50*time.Millisecond)
+	stub := newStubUDPTracker(t, []string{"10.0.0.1:6881"})
+	stub.mu.Lock()
+	stub.dropConnects = 2
+	stub.mu.Unlock()
+
+	_, err := udpTracker{host: stub.host()}.Announce(testAnnounceRequest())
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if connects, _ := stub.counts(); connects != 3 {
+		t.Errorf("got %d connects, want 3", connects)
+	}
+}
+
+func TestUDPTrackerNoResponse(t *testing.T) {
+	setUDPTrackerTimeout(t, time.Millisecond)
+	stub := newStubUDPTracker(t, nil)
+	stub.mu.Lock()
+	stub.dropConnects = udpTrackerMaxRetries + 1
+	stub.mu.Unlock()
+
+	_, err := udpTracker{host: stub.host()}.Announce(testAnnounceRequest())
+	if err == nil || !strings.Contains(err.Error(), "did not respond") {
+		t.Fatalf("Announce error = %v, want no response", err)
+	}
+	// One try with each timeout of the schedule
+	if connects, _ := stub.counts(); connects != udpTrackerMaxRetries+1 {
+		t.Errorf("got %d connects, want %d", connects, udpTrackerMaxRetries+1)
+	}
+}
+
+func TestUDPTrackerDeadline(t *testing.T) {
+	setUDPTrackerTimeout(t, time.Second)
+	old := udpTrackerDeadline
+	udpTrackerDeadline = 100 * time.Millisecond
+	t.Cleanup(func() { udpTrackerDeadline = old })
+
+	start := time.Now()
+	_, err := udpTracker{host: newSilentUDPTracker(t)}.Announce(testAnnounceRequest())
+	if err == nil || !strings.Contains(err.Error(), "did not respond") {
+		t.Fatalf("Announce error = %v, want no response", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Announce to a silent tracker took %v, want about %v", elapsed, udpTrackerDeadline)
+	}
+}
+
+func TestUDPTrackerFailover(t *testing.T) {
+	setUDPTrackerTimeout(t, 20*time.Millisecond)
+	want := []string{"10.0.0.1:6881"}
+	stub := newStubUDPTracker(t, want)
+	tiers := NewTrackerTiers([][]string{
+		{"udp://" + newSilentUDPTracker(t) + "/announce"},
+		{"udp://" + stub.host() + "/announce"},
+	})
+
+	start := time.Now()
+	resp, err := tiers.Announce(testAnnounceRequest())
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if !reflect.DeepEqual(resp.Peers, want) {
+		t.Errorf("peers = %v, want %v", resp.Peers, want)
+	}
+	// The silent tracker is given up after the retries of its schedule
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("failover to the next tier took %v", elapsed)
+	}
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// VerifyReport is the result of checking local data against the piece hashes of a torrent.
+type VerifyReport struct {
+	TotalPieces int   `json:"total_pieces"`
+	GoodPieces  int   `json:"good_pieces"`
+	BadPieces   []int `json:"bad_pieces"`
+	// Completion is the percentage of good pieces
+	Completion float64            `json:"completion"`
+	Files      []FileVerifyReport `json:"files"`
+}
+
+// FileVerifyReport is the state of a single file on disk.
+type FileVerifyReport struct {
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+	// Missing is set if the file doesn't exist, even if it is empty and holds no piece
+	Missing bool `json:"missing"`
+	// ActualLength is the size of the file on disk, which is larger than Length if it has extra bytes
+	ActualLength int `json:"actual_length"`
+	// BadPieces are the bad pieces holding bytes of the file
+	BadPieces []int `json:"bad_pieces"`
+}
+
+// Complete reports whether the file exists with the right size, and every piece holding bytes of it is good.
+func (f FileVerifyReport) Complete() bool {
+	return !f.Missing && f.ActualLength == f.Length && len(f.BadPieces) == 0
+}
+
+// VerifyData hashes the data of the torrent stored at path, laid out like DownloadFile, against its piece hashes.
+// Missing or short files make the pieces they hold bad; The data is never modified.
+// Pieces are hashed by `workers` goroutines, or one per CPU if workers <= 0.
+func VerifyData(info MetaInfo, path string, workers int) (VerifyReport, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	err := checkPieceCount(info)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	files := outputFiles(info, path)
+	handles := make(map[string]*os.File)
+	sizes := make(map[string]int)
+	for _, f := range files {
+		filePath := filepath.Join(f.Path...)
+		file, err := os.Open(filePath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			var stat os.FileInfo
+			stat, err = file.Stat()
+			if err == nil {
+				sizes[filePath] = int(stat.Size())
+			}
+		}
+		if err != nil {
+			closeFiles(handles)
+			return VerifyReport{}, fmt.Errorf("failed to open file: %v", err)
+		}
+		handles[filePath] = file
+	}
+	defer closeFiles(handles)
+
+	good := make([]bool, len(info.Pieces))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				// Each worker writes its own entries of good, so no lock is needed
+				good[index] = verifyLocalPiece(info, files, handles, index)
+			}
+		}()
+	}
+	for i := range info.Pieces {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	report := VerifyReport{TotalPieces: len(info.Pieces), BadPieces: make([]int, 0)}
+	for i, ok := range good {
+		if ok {
+			report.GoodPieces++
+		} else {
+			report.BadPieces = append(report.BadPieces, i)
+		}
+	}
+	report.Completion = 100
+	if report.TotalPieces > 0 {
+		report.Completion = float64(report.GoodPieces) * 100 / float64(report.TotalPieces)
+	}
+
+	for _, f := range files {
+		filePath := filepath.Join(f.Path...)
+		_, exists := handles[filePath]
+		fileReport := FileVerifyReport{
+			Path:         filePath,
+			Length:       f.Length,
+			Missing:      !exists,
+			ActualLength: sizes[filePath],
+			BadPieces:    make([]int, 0),
+		}
+		if f.Length > 0 {
+			first := f.Offset / info.PieceLength
+			last := min((f.Offset+f.Length-1)/info.PieceLength, len(good)-1)
+			for i := first; i <= last; i++ {
+				if !good[i] {
+					fileReport.BadPieces = append(fileReport.BadPieces, i)
+				}
+			}
+		}
+		report.Files = append(report.Files, fileReport)
+	}
+
+	return report, nil
+}
+
+// verifyLocalPiece reads the piece from the files it crosses and checks its hash.
+func verifyLocalPiece(info MetaInfo, files []FileInfo, handles map[string]*os.File, index int) bool {
+	piece := make([]byte, pieceSize(info, index))
+	for _, segment := range pieceSegments(files, index*info.PieceLength, len(piece)) {
+		file, ok := handles[segment.Path]
+		if !ok {
+			return false
+		}
+		_, err := file.ReadAt(piece[segment.PieceOffset:segment.PieceOffset+segment.Length], int64(segment.FileOffset))
+		if err != nil {
+			return false
+		}
+	}
+	return verifyPiece(info, index, piece) == nil
+}
+
+func closeFiles(handles map[string]*os.File) {
+	for _, file := range handles {
+		file.Close()
+	}
+}
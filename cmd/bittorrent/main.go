@@ -1,36 +1,95 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	. "github.com/codecrafters-io/bittorrent-starter-go/app"
+	"github.com/codecrafters-io/bittorrent-starter-go/app/bencode"
 )
 
 func main() {
 	// Codecrafters read Stdout for answer! So we have to write logs to Stderr!
 	fmt.Fprintln(os.Stderr, "Starting application...")
+
 	command := os.Args[1]
 
 	switch command {
 	case "decode":
+		// `--lossless` keeps strings which aren't UTF-8 as `{"$hex": ...}`; `--lossless=base64` uses base64 instead
+		marshal := bencode.MarshalBNode
+		if len(os.Args) > 3 && strings.HasPrefix(os.Args[3], "--lossless") {
+			encoding := bencode.BinaryHex
+			if _, value, ok := strings.Cut(os.Args[3], "="); ok {
+				encoding = bencode.BinaryEncoding(value)
+			}
+			marshal = func(node *bencode.BNode) ([]byte, error) {
+				return bencode.MarshalBNodeLossless(node, encoding)
+			}
+		}
+
+		// `-` decodes a stream of values from stdin, printing one JSON line per value
+		if os.Args[2] == "-" {
+			decoder := bencode.NewDecoder(os.Stdin)
+			for {
+				var decoded bencode.BNode
+				err := decoder.Decode(&decoded)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					log.Fatalf("Failed to decode bencoded value: %v", err)
+				}
+
+				jsonOutput, err := marshal(&decoded)
+				if err != nil {
+					log.Fatalf("Failed to marshal decoded value: %v", err)
+				}
+				fmt.Println(string(jsonOutput))
+			}
+			break
+		}
+
 		bencodedValue := os.Args[2]
-		decoded, err := DecodeBencode(bencodedValue)
+		decoded, err := bencode.DecodeBencode(bencodedValue)
 		if err != nil {
 			log.Fatalf("Failed to decode bencoded value: %v", err)
 		}
 
 		// Marshal the decoded value to JSON
-		jsonOutput, err := MarshalBNode(&decoded)
+		jsonOutput, err := marshal(&decoded)
 		if err != nil {
 			log.Fatalf("Failed to marshal decoded value: %v", err)
 		}
 
 		fmt.Println(string(jsonOutput))
 
+	case "encode":
+		// `-` reads the JSON from stdin
+		jsonInput := []byte(os.Args[2])
+		if os.Args[2] == "-" {
+			var err error
+			jsonInput, err = io.ReadAll(os.Stdin)
+			if err != nil {
+				log.Fatalf("Failed to read stdin: %v", err)
+			}
+		}
+
+		node, err := bencode.UnmarshalBNodeLossless(jsonInput)
+		if err != nil {
+			log.Fatalf("Failed to parse JSON value: %v", err)
+		}
+		os.Stdout.Write(bencode.EncodeBNode(node))
+
 	case "info":
 		torrentFilePath := os.Args[2]
 
@@ -49,9 +108,22 @@ func main() {
 		for _, piece := range metaInfo.Pieces {
 			fmt.Printf("%x\n", piece)
 		}
+		if metaInfo.IsMultiFile() {
+			fmt.Println("Name:", metaInfo.Name)
+			fmt.Println("Files:")
+			for _, file := range metaInfo.Files {
+				fmt.Printf("%s (%d bytes)\n", filepath.Join(file.Path...), file.Length)
+			}
+		}
 
 	case "peers":
 		torrentFilePath := os.Args[2]
+
+		flags := flag.NewFlagSet("peers", flag.ExitOnError)
+		sources := peerSourceFlags(flags)
+		flags.Parse(os.Args[3:])
+		defer sources.start()()
+
 		metaInfo, err := ParseTorrentFile(torrentFilePath)
 		if err != nil {
 			log.Fatalf("Failed to parse torrent file: %v", err)
@@ -78,11 +150,11 @@ func main() {
 		}
 		defer conn.Close()
 
-		peerId, err := HandshakePeer(conn, metaInfo)
+		handshake, err := HandshakePeer(conn, metaInfo.InfoHash)
 		if err != nil {
 			log.Fatalf("Failed to handshake peer: %v", err)
 		}
-		fmt.Printf("Peer ID: %x\n", peerId)
+		printHandshake(handshake)
 
 	case "download_piece":
 		torrentFilePath := os.Args[4]
@@ -93,12 +165,16 @@ func main() {
 			log.Fatalf("Failed to parse piece index: %v", err)
 		}
 
+		flags, opts, sources := downloadFlags("download_piece")
+		flags.Parse(os.Args[6:])
+		defer sources.start()()
+
 		metaInfo, err := ParseTorrentFile(torrentFilePath)
 		if err != nil {
 			log.Fatalf("Failed to parse torrent file: %v", err)
 		}
 
-		err = DownloadPiece(metaInfo, pieceIndex, resultFilePath)
+		err = DownloadPiece(metaInfo, pieceIndex, resultFilePath, *opts)
 		if err != nil {
 			log.Fatalf("Download failed: %v", err)
 		}
@@ -107,16 +183,150 @@ func main() {
 		resultFilePath := os.Args[3]
 		torrentFilePath := os.Args[4]
 
+		flags, opts, sources := downloadFlags("download")
+		resume := flags.Bool("resume", false, "continue an interrupted download instead of starting over")
+		flags.Parse(os.Args[5:])
+		defer sources.start()()
+
 		metaInfo, err := ParseTorrentFile(torrentFilePath)
 		if err != nil {
 			log.Fatalf("Failed to parse torrent file: %v", err)
 		}
 
-		err = DownloadFile(metaInfo, resultFilePath)
+		if *resume {
+			err = ResumeDownload(metaInfo, resultFilePath, *opts)
+		} else {
+			err = DownloadFile(metaInfo, resultFilePath, *opts)
+		}
 		if err != nil {
 			log.Fatalf("Download failed: %v", err)
 		}
 
+	case "seed":
+		torrentFilePath := os.Args[2]
+		dataPath := os.Args[3]
+
+		metaInfo, err := ParseTorrentFile(torrentFilePath)
+		if err != nil {
+			log.Fatalf("Failed to parse torrent file: %v", err)
+		}
+
+		// The port is optional, so the flags start after it if it is given
+		port := DefaultPort
+		args := os.Args[4:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			port, err = strconv.Atoi(args[0])
+			if err != nil {
+				log.Fatalf("Failed to parse port: %v", err)
+			}
+			args = args[1:]
+		}
+		flags := flag.NewFlagSet("seed", flag.ExitOnError)
+		sources := peerSourceFlags(flags)
+		flags.Parse(args)
+		defer sources.start()()
+
+		seeder := NewSeeder(port)
+		err = seeder.AddTorrent(metaInfo, dataPath)
+		if err != nil {
+			log.Fatalf("Failed to add torrent: %v", err)
+		}
+		AnnounceToPeerSources(metaInfo.InfoHash, port)
+
+		err = seeder.ListenAndServe()
+		seeder.Close()
+		if err != nil {
+			log.Fatalf("Seeding failed: %v", err)
+		}
+
+	case "verify":
+		torrentFilePath := os.Args[2]
+		dataPath := os.Args[3]
+
+		metaInfo, err := ParseTorrentFile(torrentFilePath)
+		if err != nil {
+			log.Fatalf("Failed to parse torrent file: %v", err)
+		}
+
+		report, err := VerifyData(metaInfo, dataPath, 0)
+		if err != nil {
+			log.Fatalf("Verify failed: %v", err)
+		}
+
+		// `--json` prints the report for scripts instead of the human readable summary
+		if len(os.Args) > 4 && os.Args[4] == "--json" {
+			jsonOutput, err := json.Marshal(report)
+			if err != nil {
+				log.Fatalf("Failed to marshal report: %v", err)
+			}
+			fmt.Println(string(jsonOutput))
+			break
+		}
+
+		bad := make(map[int]bool)
+		for _, index := range report.BadPieces {
+			bad[index] = true
+		}
+		for i := 0; i < report.TotalPieces; i++ {
+			if bad[i] {
+				fmt.Printf("Piece %d: bad\n", i)
+			} else {
+				fmt.Printf("Piece %d: good\n", i)
+			}
+		}
+		for _, file := range report.Files {
+			switch {
+			case file.Missing:
+				fmt.Printf("Missing file: %s\n", file.Path)
+			case file.ActualLength > file.Length:
+				fmt.Printf("File too large: %s (%d bytes, expected %d)\n", file.Path, file.ActualLength, file.Length)
+			}
+			if len(file.BadPieces) > 0 {
+				fmt.Printf("Affected file: %s (%d bad pieces)\n", file.Path, len(file.BadPieces))
+			}
+		}
+		fmt.Printf("Completion: %.2f%% (%d/%d pieces)\n", report.Completion, report.GoodPieces, report.TotalPieces)
+
+	case "create":
+		resultFilePath := os.Args[3]
+		sourcePath := os.Args[4]
+
+		var tiers, webSeeds stringList
+		flags := flag.NewFlagSet("create", flag.ExitOnError)
+		pieceLength := flags.Int("piece-length", DefaultCreatePieceLength, "piece length in bytes")
+		announce := flags.String("announce", "", "main tracker URL")
+		flags.Var(&tiers, "tier", "comma separated tracker URLs of an announce-list tier; repeatable")
+		comment := flags.String("comment", "", "free-form comment")
+		createdBy := flags.String("created-by", "", "name of the program creating the torrent")
+		private := flags.Bool("private", false, "set the private flag")
+		flags.Var(&webSeeds, "web-seed", "web seed URL; repeatable")
+		flags.Parse(os.Args[5:])
+
+		announceList := make([][]string, 0, len(tiers))
+		for _, tier := range tiers {
+			announceList = append(announceList, strings.Split(tier, ","))
+		}
+
+		torrent, err := CreateTorrent(sourcePath, CreateOptions{
+			PieceLength:  *pieceLength,
+			Announce:     *announce,
+			AnnounceList: announceList,
+			Comment:      *comment,
+			CreatedBy:    *createdBy,
+			CreationDate: time.Now(),
+			Private:      *private,
+			WebSeeds:     webSeeds,
+		})
+		if err != nil {
+			log.Fatalf("Failed to create torrent: %v", err)
+		}
+
+		err = WriteTorrentFile(resultFilePath, torrent)
+		if err != nil {
+			log.Fatalf("Failed to write torrent: %v", err)
+		}
+		fmt.Printf("Info Hash: %x\n", CalculateInfoHash(*torrent.Dict["info"]))
+
 	case "magnet_parse":
 		magnetLink := os.Args[2]
 		metaInfo, err := ParseMagnetLink(magnetLink)
@@ -129,6 +339,12 @@ func main() {
 
 	case "magnet_handshake":
 		magnetLink := os.Args[2]
+
+		flags := flag.NewFlagSet("magnet_handshake", flag.ExitOnError)
+		sources := peerSourceFlags(flags)
+		flags.Parse(os.Args[3:])
+		defer sources.start()()
+
 		metaInfo, err := ParseMagnetLink(magnetLink)
 		if err != nil {
 			log.Fatalf("Failed to parse magnet link: %v", err)
@@ -138,21 +354,176 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to get peers: %v", err)
 		}
+		if len(peers) == 0 {
+			log.Fatalf("Failed to get peers: no peers found")
+		}
 
-		conn, err := net.Dial("tcp", peers[0])
+		conn, handshake, extHandshake, err := MagnetHandshake(peers[0], metaInfo.InfoHash)
 		if err != nil {
-			log.Fatalf("Failed to connect to peer: %v", err)
+			log.Fatalf("Failed to handshake peer: %v", err)
 		}
 		defer conn.Close()
+		fmt.Printf("Peer ID: %x\n", handshake.PeerID)
+		fmt.Println("Peer Metadata Extension ID:", extHandshake.Extensions["ut_metadata"])
 
-		peerId, err := HandshakeMagnetPeer(conn, metaInfo)
+	case "magnet_info":
+		magnetLink := os.Args[2]
+
+		flags := flag.NewFlagSet("magnet_info", flag.ExitOnError)
+		sources := peerSourceFlags(flags)
+		flags.Parse(os.Args[3:])
+		defer sources.start()()
+
+		magnetInfo, err := ParseMagnetLink(magnetLink)
 		if err != nil {
-			log.Fatalf("Failed to handshake peer: %v", err)
+			log.Fatalf("Failed to parse magnet link: %v", err)
+		}
+
+		metaInfo, err := FetchMagnetMetaInfo(magnetInfo)
+		if err != nil {
+			log.Fatalf("Failed to fetch metadata: %v", err)
+		}
+
+		fmt.Println("Tracker URL:", metaInfo.TrackerUrl)
+		fmt.Println("Length:", metaInfo.Length)
+		fmt.Printf("Info Hash: %x\n", metaInfo.InfoHash)
+		fmt.Println("Piece Length:", metaInfo.PieceLength)
+		fmt.Println("Piece Hashes:")
+		for _, piece := range metaInfo.Pieces {
+			fmt.Printf("%x\n", piece)
+		}
+
+	case "magnet_download":
+		resultFilePath := os.Args[3]
+		magnetLink := os.Args[4]
+
+		flags, opts, sources := downloadFlags("magnet_download")
+		flags.Parse(os.Args[5:])
+		defer sources.start()()
+
+		magnetInfo, err := ParseMagnetLink(magnetLink)
+		if err != nil {
+			log.Fatalf("Failed to parse magnet link: %v", err)
+		}
+
+		metaInfo, err := FetchMagnetMetaInfo(magnetInfo)
+		if err != nil {
+			log.Fatalf("Failed to fetch metadata: %v", err)
+		}
+
+		err = DownloadFile(metaInfo, resultFilePath, *opts)
+		if err != nil {
+			log.Fatalf("Download failed: %v", err)
 		}
-		fmt.Printf("Peer ID: %x\n", peerId)
 
 	default:
 		// Handle unknown commands
 		log.Fatalf("Unknown command: %s", command)
 	}
 }
+
+// downloadFlags returns a flag set with the options shared by the download commands, and the options and
+// peer sources it fills in.
+func downloadFlags(name string) (*flag.FlagSet, *DownloadOptions, *peerSources) {
+	opts := &DownloadOptions{PipelineDepth: DefaultPipelineDepth}
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	sources := peerSourceFlags(flags)
+	flags.Func("pipeline", fmt.Sprintf("number of block requests kept in flight with each peer (default %d)", DefaultPipelineDepth), func(value string) error {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 1 {
+			return fmt.Errorf("invalid pipeline depth %q", value)
+		}
+		opts.PipelineDepth = depth
+		return nil
+	})
+	return flags, opts, sources
+}
+
+// peerSources are the peer sources a command which finds peers uses along with the trackers.
+type peerSources struct {
+	dht bool
+	lsd bool
+}
+
+// peerSourceFlags adds the `--dht` and `--lsd` flags to the flag set, and returns the peer sources they enable.
+func peerSourceFlags(flags *flag.FlagSet) *peerSources {
+	sources := &peerSources{}
+	flags.BoolVar(&sources.dht, "dht", false, "find peers in the mainline DHT too, so trackerless torrents work")
+	flags.BoolVar(&sources.lsd, "lsd", false, "find peers on the local network too")
+	return sources
+}
+
+// start starts the enabled peer sources, and returns a function which closes them.
+func (s *peerSources) start() func() {
+	var closers []io.Closer
+	if s.dht {
+		closers = append(closers, startDHT())
+	}
+	if s.lsd {
+		lsd, err := NewLSD()
+		if err != nil {
+			log.Fatalf("Failed to start local service discovery: %v", err)
+		}
+		AddPeerSource(lsd)
+		closers = append(closers, lsd)
+	}
+	return func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+}
+
+// startDHT joins the DHT on the default port and registers it as a peer source.
+// The node state is kept in the user cache directory between runs.
+func startDHT() *DHT {
+	statePath := ""
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		statePath = filepath.Join(cacheDir, "bittorrent", "dht.state")
+	}
+
+	dht, err := NewDHT(DefaultPort, statePath)
+	if err != nil {
+		log.Fatalf("Failed to start DHT: %v", err)
+	}
+	err = dht.Bootstrap(DHTBootstrapNodes)
+	if err != nil {
+		log.Printf("Failed to bootstrap DHT: %v", err)
+	} else if err = dht.Save(); err != nil {
+		log.Printf("Failed to save DHT state: %v", err)
+	}
+	log.Printf("DHT node on %s knows %d nodes", dht.Addr(), dht.Nodes())
+
+	AddPeerSource(dht)
+	return dht
+}
+
+// printHandshake prints the peer ID of a handshake, then the client and the capabilities of the peer.
+func printHandshake(handshake PeerHandshake) {
+	fmt.Printf("Peer ID: %x\n", handshake.PeerID)
+	if handshake.Client != "" {
+		fmt.Println("Client:", handshake.Client)
+	}
+	fmt.Println("Extension protocol:", yesNo(handshake.Extensions))
+	fmt.Println("DHT:", yesNo(handshake.DHT))
+	fmt.Println("Fast extension:", yesNo(handshake.Fast))
+}
+
+func yesNo(ok bool) string {
+	if ok {
+		return "yes"
+	}
+	return "no"
+}
+
+// stringList is a flag which can be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}